@@ -45,6 +45,9 @@ func (c *Core) Load() error {
 	if err := c.hydrateSets(); err != nil {
 		return fmt.Errorf("hydrating tasks: %s", err)
 	}
+	if err := c.checkBecome(); err != nil {
+		return fmt.Errorf("checking privilege escalation: %s", err)
+	}
 	return nil
 }
 
@@ -99,32 +102,56 @@ func (c *Core) loadTasks() error {
 	return nil
 }
 
-// Returns the credential named by Target; or nil, if no credential was requested. If an error occurs, error will be
-// non-nil and credential will be nil.
-func (c *Core) credentialForTarget(t *types.Target) (*types.Credential, error) {
+// Returns the credentials named by Target, in the order they should be tried; or nil, if no credential was requested.
+// If an error occurs, error will be non-nil and credentials will be nil.
+func (c *Core) credentialsForTarget(t *types.Target) ([]*types.Credential, error) {
 	if t == nil {
-		return nil, fmt.Errorf("credentialForTarget called with nil target")
+		return nil, fmt.Errorf("credentialsForTarget called with nil target")
+	}
+
+	names := t.CredentialNames
+	if t.CredentialName != "" {
+		names = append([]string{t.CredentialName}, names...)
 	}
-	if t.CredentialName == "" {
+	if len(names) == 0 {
 		log.Warningf("target %s did not request a credential", t.Name)
 		return nil, nil
 	}
 
+	creds := make([]*types.Credential, 0, len(names))
+	for _, name := range names {
+		cred, err := c.credentialByName(name)
+		if err != nil {
+			return nil, fmt.Errorf("%s for target %s", err, t.Name)
+		}
+		creds = append(creds, cred)
+	}
+	return creds, nil
+}
+
+func (c *Core) credentialByName(name string) (*types.Credential, error) {
 	for i, cred := range c.Credentials {
-		if cred.Name == t.CredentialName {
+		if cred.Name == name {
 			return c.Credentials[i], nil
 		}
 	}
-	return nil, fmt.Errorf("no credential '%s' for target %s", t.CredentialName, t.Name)
+	return nil, fmt.Errorf("no credential '%s'", name)
 }
 
 func (c *Core) populateModules() {
 	if c.Modules == nil {
 		c.Modules = map[string]module.Module{
-			"cmd":     &module.Cmd{},
-			"file":    &module.File{},
-			"package": &module.Package{},
-			"survey":  &module.Survey{},
+			"apt_repository": &module.AptRepository{},
+			"blockinfile":    &module.BlockInFile{},
+			"cmd":            &module.Cmd{},
+			"fetch":          &module.Fetch{},
+			"file":           &module.File{},
+			"ini_file":       &module.IniFile{},
+			"lineinfile":     &module.LineInFile{},
+			"package":        &module.Package{},
+			"service":        &module.Service{},
+			"survey":         &module.Survey{},
+			"sync":           &module.Sync{},
 		}
 	}
 }
@@ -132,15 +159,16 @@ func (c *Core) populateModules() {
 func (c *Core) populateTransports() {
 	if c.Transports == nil {
 		c.Transports = map[string]transport.TransportConnect{
-			"SSH": (*transport.SSH)(nil).Connect,
+			"SSH":    (*transport.SSH)(nil).Connect,
+			"local":  (*transport.Local)(nil).Connect,
+			"chroot": (*transport.Chroot)(nil).Connect,
 		}
 	}
 }
 
 func (c *Core) transportForTarget(t *types.Target) (transport.Transport, error) {
-	cred, err := c.credentialForTarget(t)
-	if err != nil {
-		return nil, fmt.Errorf("obtaining transport: %s", err)
+	if t == nil {
+		return nil, fmt.Errorf("transportForTarget called with nil target")
 	}
 
 	c.populateTransports()
@@ -149,9 +177,19 @@ func (c *Core) transportForTarget(t *types.Target) (transport.Transport, error)
 		t.TransportName = "SSH"
 	}
 
+	if t.Archive != "" && t.Archive[0] != '/' {
+		t.Archive = c.pathForFile(t.Archive, "")
+	}
+
+	for _, hop := range append([]*types.Target{t}, t.Jumps...) {
+		if hop.KnownHosts != "" && hop.KnownHosts[0] != '/' && hop.KnownHosts[0] != '~' {
+			hop.KnownHosts = c.pathForFile(hop.KnownHosts, "")
+		}
+	}
+
 	for trName, trConn := range c.Transports {
 		if t.TransportName == trName {
-			return trConn(t, cred)
+			return trConn(t, c.credentialsForTarget)
 		}
 	}
 	return nil, fmt.Errorf("no transport '%s' for target %s", t.TransportName, t.Name)
@@ -196,8 +234,88 @@ func (c *Core) checkWhen(params map[string]string) bool {
 	return true
 }
 
-func (c *Core) runSet(target *types.Target, transport transport.Transport, set *types.Set) (bool, error) {
+// checkBecome rejects su on targets that have a becomeCredentialName, before anything is run rather than once the
+// target is connected to: su reads a password only from a terminal, which commands run through a transport don't have
+// (see transport.NewBecome). The settings are merged across targets, sets and tasks just as runSet does.
+func (c *Core) checkBecome() error {
+	for _, target := range c.Targets {
+		if target.BecomeCredentialName == "" {
+			continue
+		}
+		set := &types.Set{Name: "implicit", Tasks: target.Tasks}
+		if err := c.checkBecomeSet(target, set, target.Become, map[*types.Set]bool{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Core) checkBecomeSet(target *types.Target, set *types.Set, become types.Become, active map[*types.Set]bool) error {
+	if active[set] {
+		return nil
+	}
+	active[set] = true
+	defer delete(active, set)
+
+	become = become.Merge(set.Become)
+	for taskIdx, task := range set.Tasks {
+		name := "task"
+		if task.Name != "" {
+			name = task.Name
+		}
+		taskBecome := become.Merge(task.Become)
+		if params, ok := task.Modules["set"]; ok {
+			if recurSet, ok := c.setMap[params["name"]]; ok {
+				if err := c.checkBecomeSet(target, recurSet, taskBecome, active); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if taskBecome.Enabled() && taskBecome.Method == "su" {
+			return fmt.Errorf("%s/%s/%s (%d) becomes another user via su, which can't be given the password from "+
+				"becomeCredentialName %s; log in as root, or use sudo", target.Name, set.Name, name, taskIdx,
+				target.BecomeCredentialName)
+		}
+	}
+	return nil
+}
+
+// becomeTransport wraps tr for privilege escalation, if the given settings ask for it.
+func (c *Core) becomeTransport(target *types.Target, tr transport.Transport, become types.Become) (transport.Transport, error) {
+	if !become.Enabled() {
+		return tr, nil
+	}
+
+	// su can't be given a password (see transport.NewBecome), so it doesn't get the login password by default.
+	password := ""
+	if target.BecomeCredentialName != "" {
+		cred, err := c.credentialByName(target.BecomeCredentialName)
+		if err != nil {
+			return nil, fmt.Errorf("obtaining become password for target %s: %s", target.Name, err)
+		}
+		if cred.Kind() != types.CredentialPassword {
+			return nil, fmt.Errorf("become credential %s for target %s is not a password", cred.Name, target.Name)
+		}
+		password = cred.Value
+	} else if become.Method != "su" {
+		creds, err := c.credentialsForTarget(target)
+		if err != nil {
+			return nil, fmt.Errorf("obtaining become password: %s", err)
+		}
+		for _, cred := range creds {
+			if cred.Kind() == types.CredentialPassword {
+				password = cred.Value
+				break
+			}
+		}
+	}
+	return transport.NewBecome(tr, become, password)
+}
+
+func (c *Core) runSet(target *types.Target, tr transport.Transport, set *types.Set, become types.Become) (bool, error) {
 	setChange := false
+	become = become.Merge(set.Become)
 tasks:
 	for taskIdx, task := range set.Tasks {
 		name := "task"
@@ -222,7 +340,7 @@ tasks:
 			if c.checkWhen(params) {
 				log.Debugf("%s/%s/%s (%d) running set '%s' by-reference", target.Name, set.Name, name, taskIdx, recurName)
 				c.Execs++
-				change, err := c.runSet(target, transport, recurSet)
+				change, err := c.runSet(target, tr, recurSet, become.Merge(task.Become))
 				if err != nil {
 					log.Warningf("%s/%s/%s (%d) task set %s failed: %s", target.Name, set.Name, name, taskIdx, recurName, err)
 					continue
@@ -245,13 +363,22 @@ tasks:
 					continue tasks
 				}
 				log.Debugf("%s/%s (%d)/%s: running", target.Name, name, taskIdx, moduleName)
+				target.Metadata["task"] = name
 				c.Execs++
 				err := moduleObj.Configure(target, params)
 				if err != nil {
 					log.Warningf("%s/%s (%d)/%s could not configure: %s", target.Name, name, taskIdx, moduleName, err)
 					continue tasks
 				}
-				change, err := moduleObj.Execute(target, transport)
+				taskTr, err := c.becomeTransport(target, tr, become.Merge(task.Become))
+				if err != nil {
+					log.Warningf("%s/%s (%d)/%s could not escalate privileges: %s", target.Name, name, taskIdx, moduleName, err)
+					continue tasks
+				}
+				change, err := moduleObj.Execute(target, taskTr)
+				if err != nil {
+					log.Warningf("%s/%s (%d)/%s failed: %s", target.Name, name, taskIdx, moduleName, err)
+				}
 				if change {
 					c.Changes++
 					c.register(params)
@@ -273,12 +400,13 @@ func (c *Core) runTarget(target *types.Target) {
 		return
 	}
 	defer tr.Close()
-	c.runSet(target, tr, &types.Set{"implicit", target.Tasks})
+	c.runSet(target, tr, &types.Set{Name: "implicit", Tasks: target.Tasks}, target.Become)
 }
 
 func (c *Core) Run() error {
 	c.populateTransports()
 	c.populateModules()
+	defer transport.CloseJumps()
 
 	if c.Modules == nil || len(c.Modules) == 0 {
 		log.Warningf("no module defined in Core")
@@ -333,17 +461,29 @@ func (c *Core) readFile(path, defaultPath string) ([]byte, error) {
 func (c *Core) loadCredentials() error {
 
 	path := c.pathForFile(c.CredentialFile, "credentials.yml")
+	c.Credentials = []*types.Credential{}
+	if _, err := os.Stat(path); c.CredentialFile == "" && os.IsNotExist(err) {
+		// Not every transport needs credentials; so the default file is optional.
+		log.Debugf("no credentials file at %s", path)
+		return nil
+	}
+
 	credentialYaml, err := c.readFile(c.CredentialFile, "credentials.yml")
 	if err != nil {
 		return fmt.Errorf("reading %s: %s", path, err)
 	}
 
-	c.Credentials = []*types.Credential{}
 	if err := yaml.Unmarshal(credentialYaml, &c.Credentials); err != nil {
 		return fmt.Errorf("parsing %s: %s", path, err)
 	}
 	log.Debugf("unmarshalled %d credentials from %s", len(c.Credentials), path)
 
+	for _, cred := range c.Credentials {
+		if cred.Kind() == types.CredentialKey && cred.Path != "" && cred.Path[0] != '/' {
+			cred.Path = c.pathForFile(cred.Path, "")
+		}
+	}
+
 	return nil
 }
 
@@ -0,0 +1,296 @@
+package module
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/pdbogen/gosible/transport"
+	"github.com/pdbogen/gosible/types"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	aptSourcesDir  = "/etc/apt/sources.list.d"
+	aptKeyringsDir = "/etc/apt/keyrings"
+)
+
+// AptRepository adds a third-party apt repository: a file in sources.list.d, whose entries only trust the repository's
+// own signing key, kept in /etc/apt/keyrings. The package index is refreshed if either of them changed.
+type AptRepository struct {
+	name        string
+	repo        []string
+	key         []byte
+	absent      bool
+	updateCache bool
+}
+
+// aptRepoName is what's allowed in the name of a file in sources.list.d; apt ignores files with other characters.
+var aptRepoName = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// defaultRepoName derives a name from the host of the first entry's URL, e.g. packages_example_com.
+func defaultRepoName(entry string) string {
+	for _, field := range strings.Fields(entry) {
+		if i := strings.Index(field, "://"); i >= 0 {
+			host := strings.SplitN(field[i+3:], "/", 2)[0]
+			return strings.Map(func(r rune) rune {
+				if r == '.' || r == ':' {
+					return '_'
+				}
+				return r
+			}, host)
+		}
+	}
+	return ""
+}
+
+func (a *AptRepository) Configure(target *types.Target, params map[string]string) error {
+	*a = AptRepository{updateCache: true}
+
+	switch params["state"] {
+	case "", "present":
+	case "absent":
+		a.absent = true
+	default:
+		return fmt.Errorf("apt_repository: unknown state %s", params["state"])
+	}
+
+	for _, line := range strings.Split(params["repo"], "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if fields := strings.Fields(line); len(fields) < 3 || (fields[0] != "deb" && fields[0] != "deb-src") {
+			return fmt.Errorf("apt_repository: bad entry %q; expected e.g. deb https://example.com/apt stable main", line)
+		}
+		if strings.Contains(line, "signed-by=") {
+			return fmt.Errorf("apt_repository: entry %q already has signed-by; the key is given by key or key_url", line)
+		}
+		a.repo = append(a.repo, line)
+	}
+	if len(a.repo) == 0 && !a.absent {
+		return errors.New("apt_repository configured without repo")
+	}
+
+	a.name = params["name"]
+	if a.name == "" && len(a.repo) > 0 {
+		a.name = defaultRepoName(a.repo[0])
+	}
+	if a.name == "" {
+		return errors.New("apt_repository configured without name")
+	}
+	if !aptRepoName.MatchString(a.name) {
+		return fmt.Errorf("apt_repository: name %s may only contain letters, digits, _, . and -", a.name)
+	}
+
+	if update, ok := params["update_cache"]; ok {
+		u, err := strconv.ParseBool(update)
+		if err != nil {
+			return fmt.Errorf("parsing update_cache %s: %s", update, err)
+		}
+		a.updateCache = u
+	}
+
+	if a.absent {
+		return nil
+	}
+
+	// The key is read now, so that a missing or unreachable one fails before anything is done to any target.
+	key, keyURL := params["key"], params["key_url"]
+	switch {
+	case key != "" && keyURL != "":
+		return errors.New("apt_repository configured with both key and key_url")
+	case key != "":
+		if key[0] != '/' {
+			key = strings.TrimRight(target.Metadata["rootpath"], "/") + "/" + key
+		}
+		content, err := ioutil.ReadFile(key)
+		if err != nil {
+			return fmt.Errorf("apt_repository: reading key: %s", err)
+		}
+		a.key = content
+	case keyURL != "":
+		content, err := download(keyURL)
+		if err != nil {
+			return fmt.Errorf("apt_repository: downloading key: %s", err)
+		}
+		a.key = content
+	default:
+		return errors.New("apt_repository configured with neither key nor key_url")
+	}
+	return nil
+}
+
+// downloadClient gives up on a download that takes longer than a minute, rather than hanging the run.
+var downloadClient = &http.Client{Timeout: time.Minute}
+
+type downloadResult struct {
+	content []byte
+	err     error
+}
+
+// downloads caches what download fetched, or failed to fetch, from each URL. A task is configured once per target, but
+// its key only needs downloading once.
+var downloads = struct {
+	sync.Mutex
+	byURL map[string]downloadResult
+}{byURL: map[string]downloadResult{}}
+
+// download fetches url, from wherever gosible runs.
+func download(url string) ([]byte, error) {
+	downloads.Lock()
+	defer downloads.Unlock()
+	if res, ok := downloads.byURL[url]; ok {
+		return res.content, res.err
+	}
+
+	content, err := fetchURL(url)
+	downloads.byURL[url] = downloadResult{content, err}
+	return content, err
+}
+
+func fetchURL(url string) ([]byte, error) {
+	resp, err := downloadClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// keyring is where the signing key is kept. apt reads ASCII-armored keys only from files ending in .asc, and binary
+// ones only from files ending in .gpg.
+func (a *AptRepository) keyring() string {
+	if bytes.HasPrefix(bytes.TrimSpace(a.key), []byte("-----BEGIN PGP")) {
+		return aptKeyringsDir + "/" + a.name + ".asc"
+	}
+	return aptKeyringsDir + "/" + a.name + ".gpg"
+}
+
+// sources renders the sources.list.d file, with signed-by added to each entry's options; or to any options it has
+// already.
+func (a *AptRepository) sources() string {
+	signedBy := "signed-by=" + a.keyring()
+	var out bytes.Buffer
+	for _, entry := range a.repo {
+		fields := strings.Fields(entry)
+		if rest := strings.TrimPrefix(fields[1], "["); rest == "" {
+			fields[1] = "[" + signedBy
+		} else if rest != fields[1] {
+			fields[1] = "[" + signedBy + " " + rest
+		} else {
+			fields = append([]string{fields[0], "[" + signedBy + "]"}, fields[1:]...)
+		}
+		out.WriteString(strings.Join(fields, " ") + "\n")
+	}
+	return out.String()
+}
+
+// put writes content to dest, as a root-owned file readable by all; and reports whether either changed.
+func put(tr transport.Transport, dest, content string) (bool, error) {
+	f := &File{state: stateFile, literal: &content, dest: dest, mode: octalMode(0644), uid: int32Ptr(0), gid: int32Ptr(0)}
+	prev, err := f.stat(tr)
+	if err != nil {
+		return false, err
+	}
+	if prev != nil && prev.kind != syscall.S_IFREG {
+		return false, fmt.Errorf("%s exists, and is not a regular file", dest)
+	}
+	written, err := f.writeFile(tr, prev)
+	if err != nil || written {
+		return written, err
+	}
+	modeChanged, err := f.setMode(tr, prev)
+	if err != nil {
+		return false, err
+	}
+	uidChanged, err := f.setUid(tr, prev)
+	if err != nil {
+		return false, err
+	}
+	gidChanged, err := f.setGid(tr, prev)
+	if err != nil {
+		return false, err
+	}
+	return modeChanged || uidChanged || gidChanged, nil
+}
+
+// Execute writes, or removes, the key and the sources.list.d file. A key of the other kind, .gpg or .asc, left from
+// an earlier version of the key is removed too, since apt would otherwise no longer find the file signed-by names.
+func (a *AptRepository) Execute(target *types.Target, tr transport.Transport) (bool, error) {
+	pm, err := targetPackageManager(target, tr, "")
+	if err != nil {
+		return false, err
+	}
+	if pm.name != "apt" {
+		return false, fmt.Errorf("apt_repository: %s uses %s, not apt", target.Name, pm.name)
+	}
+
+	list := aptSourcesDir + "/" + a.name + ".list"
+	var remove []string
+	changed := false
+
+	if a.absent {
+		remove = []string{list, aptKeyringsDir + "/" + a.name + ".asc", aptKeyringsDir + "/" + a.name + ".gpg"}
+	} else {
+		if _, err := run(tr, "creating "+aptKeyringsDir, "mkdir", "-p", "-m", "0755", aptKeyringsDir); err != nil {
+			return false, err
+		}
+		keyring := a.keyring()
+		keyChanged, err := put(tr, keyring, string(a.key))
+		if err != nil {
+			return false, err
+		}
+		if keyChanged {
+			log.Infof("%s: apt_repository: wrote %s", target.Name, keyring)
+		}
+		listChanged, err := put(tr, list, a.sources())
+		if err != nil {
+			return false, err
+		}
+		if listChanged {
+			log.Infof("%s: apt_repository: wrote %s", target.Name, list)
+		}
+		changed = keyChanged || listChanged
+
+		for _, ext := range []string{".asc", ".gpg"} {
+			if other := aptKeyringsDir + "/" + a.name + ext; other != keyring {
+				remove = append(remove, other)
+			}
+		}
+	}
+
+	for _, path := range remove {
+		f := &File{dest: path}
+		prev, err := f.stat(tr)
+		if err != nil {
+			return false, err
+		}
+		removed, err := f.remove(tr, prev)
+		if err != nil {
+			return false, err
+		}
+		changed = changed || removed
+	}
+
+	if changed && a.updateCache {
+		if err := refreshCache(target, tr, pm); err != nil {
+			return false, err
+		}
+	}
+	return changed, nil
+}
+
+func (*AptRepository) Name() string { return "apt_repository" }
+func (*AptRepository) Always() bool { return false }
+
+var _ Module = (*AptRepository)(nil)
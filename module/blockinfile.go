@@ -0,0 +1,99 @@
+package module
+
+import (
+	"fmt"
+	"github.com/pdbogen/gosible/transport"
+	"github.com/pdbogen/gosible/types"
+	"strings"
+)
+
+// defaultMarker surrounds a managed block, with {mark} replaced by BEGIN or END.
+const defaultMarker = "# {mark} GOSIBLE MANAGED BLOCK"
+
+// BlockInFile manages a block of lines in a file on the target, delimited by marker lines, so that the block can be
+// found and replaced on later runs.
+type BlockInFile struct {
+	editor
+	block  []string
+	begin  string
+	end    string
+	absent bool
+	where  insertion
+}
+
+func (b *BlockInFile) Configure(_ *types.Target, params map[string]string) error {
+	*b = BlockInFile{}
+	if err := b.editor.configure("blockinfile", params); err != nil {
+		return err
+	}
+
+	switch params["state"] {
+	case "", "present":
+	case "absent":
+		b.absent = true
+	default:
+		return fmt.Errorf("blockinfile: unknown state %s", params["state"])
+	}
+
+	b.block = splitLines(params["block"])
+
+	marker := defaultMarker
+	if m, ok := params["marker"]; ok {
+		if !strings.Contains(m, "{mark}") {
+			return fmt.Errorf("blockinfile: marker %q does not contain {mark}", m)
+		}
+		marker = m
+	}
+	b.begin = strings.Replace(marker, "{mark}", "BEGIN", -1)
+	b.end = strings.Replace(marker, "{mark}", "END", -1)
+
+	where, err := parseInsertion(params)
+	if err != nil {
+		return fmt.Errorf("blockinfile: %s", err)
+	}
+	b.where = where
+	return nil
+}
+
+// edit replaces the existing block, markers included, with the configured one; or removes it, for state absent. If
+// there's no block yet, one is inserted. An empty block is treated like state absent.
+func (b *BlockInFile) edit(lines []string) ([]string, error) {
+	start, stop := -1, -1
+	for i, line := range lines {
+		if start == -1 && line == b.begin {
+			start = i
+		} else if start != -1 && line == b.end {
+			stop = i
+			break
+		}
+	}
+	if start != -1 && stop == -1 {
+		return nil, fmt.Errorf("%s has %q, but no %q after it", b.dest, b.begin, b.end)
+	}
+
+	var add []string
+	if !b.absent && len(b.block) > 0 {
+		add = append(append([]string{b.begin}, b.block...), b.end)
+	}
+
+	if start == -1 {
+		if add == nil {
+			return lines, nil
+		}
+		return b.where.insert(lines, add), nil
+	}
+
+	edited := make([]string, 0, len(lines)-(stop-start+1)+len(add))
+	edited = append(edited, lines[:start]...)
+	edited = append(edited, add...)
+	return append(edited, lines[stop+1:]...), nil
+}
+
+func (b *BlockInFile) Execute(target *types.Target, tr transport.Transport) (bool, error) {
+	return b.apply(target, tr, b.edit)
+}
+
+func (*BlockInFile) Name() string { return "blockinfile" }
+func (*BlockInFile) Always() bool { return false }
+
+var _ Module = (*BlockInFile)(nil)
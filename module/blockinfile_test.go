@@ -0,0 +1,97 @@
+package module
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBlockInFileEdit(t *testing.T) {
+	const begin, end = "# BEGIN GOSIBLE MANAGED BLOCK", "# END GOSIBLE MANAGED BLOCK"
+	tests := []struct {
+		name   string
+		params map[string]string
+		lines  []string
+		want   []string
+	}{
+		{
+			"appended",
+			map[string]string{"block": "x\ny"},
+			[]string{"a"},
+			[]string{"a", begin, "x", "y", end},
+		},
+		{
+			"replaced",
+			map[string]string{"block": "new"},
+			[]string{"a", begin, "old", "older", end, "b"},
+			[]string{"a", begin, "new", end, "b"},
+		},
+		{
+			"unchanged",
+			map[string]string{"block": "x"},
+			[]string{begin, "x", end},
+			[]string{begin, "x", end},
+		},
+		{
+			"inserted at BOF",
+			map[string]string{"block": "x", "insertbefore": "BOF"},
+			[]string{"a"},
+			[]string{begin, "x", end, "a"},
+		},
+		{
+			"inserted after",
+			map[string]string{"block": "x", "insertafter": "^a"},
+			[]string{"a", "b"},
+			[]string{"a", begin, "x", end, "b"},
+		},
+		{
+			"absent",
+			map[string]string{"state": "absent"},
+			[]string{"a", begin, "x", end, "b"},
+			[]string{"a", "b"},
+		},
+		{
+			"empty block removes",
+			map[string]string{"block": ""},
+			[]string{begin, "x", end},
+			[]string{},
+		},
+		{
+			"absent and missing",
+			map[string]string{"state": "absent"},
+			[]string{"a"},
+			[]string{"a"},
+		},
+		{
+			"custom marker",
+			map[string]string{"block": "x", "marker": "// {mark} ours"},
+			[]string{"// BEGIN ours", "old", "// END ours"},
+			[]string{"// BEGIN ours", "x", "// END ours"},
+		},
+	}
+	for _, test := range tests {
+		test.params["dest"] = "/etc/x"
+		b := &BlockInFile{}
+		if err := b.Configure(nil, test.params); err != nil {
+			t.Errorf("%s: configuring: %s", test.name, err)
+			continue
+		}
+		got, err := b.edit(test.lines)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) && !(len(got) == 0 && len(test.want) == 0) {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestBlockInFileUnterminated(t *testing.T) {
+	b := &BlockInFile{}
+	if err := b.Configure(nil, map[string]string{"dest": "/etc/x", "block": "x"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.edit([]string{"# BEGIN GOSIBLE MANAGED BLOCK", "x"}); err == nil {
+		t.Errorf("block without an end marker edited without error")
+	}
+}
@@ -1,48 +1,62 @@
 package module
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"github.com/pdbogen/gosible/transport"
 	"github.com/pdbogen/gosible/types"
-	"strings"
+	"io"
 )
 
 type Cmd struct {
-	cmd string
+	cmd      string
+	register string
 }
 
 func (*Cmd) Always() bool { return false }
 
 func (c *Cmd) Configure(_ *types.Target, params map[string]string) error {
+	*c = Cmd{}
 	if cmd, ok := params["cmd"]; !ok {
 		return errors.New("cmd called with no `cmd` set")
 	} else {
 		c.cmd = cmd
 	}
+	c.register = params["register"]
 	return nil
 }
 
+// Execute streams the command's output to the log as it arrives. It's only held in memory when the task is
+// registered, in which case stdout is kept in the target's metadata as <register>_stdout.
 func (c *Cmd) Execute(target *types.Target, transport transport.Transport) (change bool, err error) {
-	stdout, stderr, res, err := transport.Do([]string{
-		"sh", "-c", c.cmd,
-	})
-	if err != nil {
-		return false, fmt.Errorf("error running command: %s", err)
-	}
+	outLog := newLineLogger(target, "out")
+	errLog := newLineLogger(target, "err")
+	defer outLog.Flush()
+	defer errLog.Flush()
 
-	for _, line := range strings.Split(string(stdout), "\n") {
-		log.Debugf("cmd:out: %s", line)
+	var stdout io.Writer = outLog
+	var captured *bytes.Buffer
+	if c.register != "" {
+		captured = &bytes.Buffer{}
+		stdout = io.MultiWriter(outLog, captured)
 	}
 
-	for _, line := range strings.Split(string(stderr), "\n") {
-		log.Debugf("cmd:err: %s", line)
+	res, err := transport.DoStream([]string{
+		"sh", "-c", c.cmd,
+	}, &bytes.Buffer{}, stdout, errLog)
+	if err != nil {
+		return false, fmt.Errorf("error running command: %s", err)
 	}
 
 	if res != 0 {
 		return false, fmt.Errorf("non-zero running command %s: %d", c.cmd, res)
 	}
 
+	if captured != nil {
+		registerResult(target, c.register, "stdout", captured.String())
+	}
+
 	return true, nil
 }
 
@@ -0,0 +1,187 @@
+package module
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/pdbogen/gosible/transport"
+	"github.com/pdbogen/gosible/types"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// editor holds what LineInFile and BlockInFile have in common: they read a file from the target, change some of its
+// lines, and write it back via File, so that it's replaced atomically, validated and backed up as File would.
+type editor struct {
+	dest      string
+	create    bool
+	validate  string
+	backup    bool
+	backupDir string
+	register  string
+}
+
+func (e *editor) configure(name string, params map[string]string) error {
+	*e = editor{}
+	if dst, ok := params["dest"]; !ok || dst == "" {
+		return fmt.Errorf("%s configured without destination", name)
+	} else {
+		e.dest = dst
+	}
+
+	for _, flag := range []struct {
+		name string
+		ptr  *bool
+	}{{"create", &e.create}, {"backup", &e.backup}} {
+		if v, ok := params[flag.name]; ok {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return fmt.Errorf("parsing %s %s: %s", flag.name, v, err)
+			}
+			*flag.ptr = b
+		}
+	}
+
+	if validate, ok := params["validate"]; ok {
+		if !strings.Contains(validate, "%s") {
+			return fmt.Errorf("validate command %q does not contain %%s", validate)
+		}
+		e.validate = validate
+	}
+	e.backupDir = params["backup_dir"]
+	e.register = params["register"]
+	return nil
+}
+
+// apply reads dest, passes its lines to edit, and writes the result back if the lines changed. If dest doesn't exist,
+// edit is given no lines, but its result is only written if create is set; otherwise, it's an error for edit to add
+// any.
+func (e *editor) apply(target *types.Target, tr transport.Transport, edit func([]string) ([]string, error)) (bool, error) {
+	f := &File{state: stateFile, dest: e.dest, validate: e.validate, backup: e.backup, backupDir: e.backupDir, follow: true}
+	prev, err := f.stat(tr)
+	if err != nil {
+		return false, err
+	}
+	// A link is edited through, just as File writes through one by default.
+	if prev, err = f.followLink(tr, prev); err != nil {
+		return false, err
+	}
+	if prev != nil && prev.kind != syscall.S_IFREG {
+		return false, fmt.Errorf("%s exists, and is not a regular file", f.dest)
+	}
+
+	var lines []string
+	if prev != nil {
+		buf := &bytes.Buffer{}
+		if err := tr.Get(f.dest, buf); err != nil {
+			return false, fmt.Errorf("reading %s: %s", f.dest, err)
+		}
+		lines = splitLines(buf.String())
+	}
+
+	edited, err := edit(lines)
+	if err != nil {
+		return false, err
+	}
+	if equalLines(lines, edited) {
+		return false, nil
+	}
+	if prev == nil && !e.create {
+		return false, fmt.Errorf("%s does not exist, and create is not set", f.dest)
+	}
+
+	content := ""
+	if len(edited) > 0 {
+		content = strings.Join(edited, "\n") + "\n"
+	}
+	f.literal = &content
+	changed, err := f.writeFile(tr, prev)
+	if err != nil {
+		return false, err
+	}
+	recordBackup(target, e.register, f.backupPath)
+	return changed, nil
+}
+
+// splitLines splits content into lines, without their newlines.
+func splitLines(content string) []string {
+	if content == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(content, "\n"), "\n")
+}
+
+func equalLines(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// insertion says where new lines go when there's nothing for them to replace: after the last line matching after,
+// or before the first line matching before, or at the end (or, for BOF, the start) of the file.
+type insertion struct {
+	after  *regexp.Regexp
+	before *regexp.Regexp
+	bof    bool
+}
+
+func parseInsertion(params map[string]string) (insertion, error) {
+	var ins insertion
+	after, afterOk := params["insertafter"]
+	before, beforeOk := params["insertbefore"]
+	if afterOk && beforeOk {
+		return ins, errors.New("insertafter and insertbefore are mutually exclusive")
+	}
+
+	var err error
+	switch {
+	case afterOk && after != "EOF":
+		if ins.after, err = regexp.Compile(after); err != nil {
+			return ins, fmt.Errorf("parsing insertafter %s: %s", after, err)
+		}
+	case beforeOk && before == "BOF":
+		ins.bof = true
+	case beforeOk:
+		if ins.before, err = regexp.Compile(before); err != nil {
+			return ins, fmt.Errorf("parsing insertbefore %s: %s", before, err)
+		}
+	}
+	return ins, nil
+}
+
+// insert returns lines with add inserted as described by ins. If the line it's meant to go after or before isn't
+// found, add goes at the end.
+func (ins insertion) insert(lines, add []string) []string {
+	at := len(lines)
+	switch {
+	case ins.bof:
+		at = 0
+	case ins.after != nil:
+		for i := len(lines) - 1; i >= 0; i-- {
+			if ins.after.MatchString(lines[i]) {
+				at = i + 1
+				break
+			}
+		}
+	case ins.before != nil:
+		for i, line := range lines {
+			if ins.before.MatchString(line) {
+				at = i
+				break
+			}
+		}
+	}
+
+	ret := make([]string, 0, len(lines)+len(add))
+	ret = append(ret, lines[:at]...)
+	ret = append(ret, add...)
+	return append(ret, lines[at:]...)
+}
@@ -0,0 +1,178 @@
+package module
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/pdbogen/gosible/transport"
+	"github.com/pdbogen/gosible/types"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Fetch copies files from the target to the local machine, into a directory per target.
+type Fetch struct {
+	source   string
+	dest     string
+	register string
+}
+
+func (f *Fetch) Configure(target *types.Target, params map[string]string) error {
+	*f = Fetch{}
+	if src, ok := params["source"]; !ok || src == "" {
+		return errors.New("fetch configured without source")
+	} else {
+		f.source = src
+	}
+
+	f.dest = "fetched"
+	if dst, ok := params["dest"]; ok && dst != "" {
+		f.dest = dst
+	}
+	if f.dest[0] != '/' {
+		f.dest = strings.TrimRight(target.Metadata["rootpath"], "/") + "/" + f.dest
+	}
+
+	if target.Name == "" || strings.Contains(target.Name, "/") || strings.Contains(target.Name, "..") {
+		return fmt.Errorf("fetch: target name %q can't be used as a directory name", target.Name)
+	}
+
+	f.register = params["register"]
+	return nil
+}
+
+// remoteFile is a regular file on the target, as listed by Fetch.list.
+type remoteFile struct {
+	path string
+	mode os.FileMode
+	hash string
+}
+
+// fetchListScript lists the regular files at or under $1, exiting 3 if it doesn't exist. Each is printed as
+// "<permissions> <sha256> <path>\0". stat and sha256sum are run once per file, reading it from stdin, since BusyBox can't
+// NUL-terminate their output.
+const fetchListScript = `[ -e "$1" ] || exit 3
+find "$1" -type f -exec sh -c 'for p; do
+	m=$(stat -c "%a" "$p") && h=$(sha256sum < "$p") || exit 1
+	printf "%s %s %s\0" "$m" "${h%% *}" "$p"
+done' sh {} +`
+
+// list finds the regular files at or under source on the target, with their permissions and checksums.
+func (f *Fetch) list(tr transport.Transport) ([]*remoteFile, error) {
+	out, stderr, res, err := tr.Do([]string{"sh", "-c", fetchListScript, "sh", f.source})
+	if err != nil {
+		return nil, fmt.Errorf("listing %s: %s", f.source, err)
+	}
+	if res == 3 {
+		return nil, fmt.Errorf("%s does not exist on target", f.source)
+	}
+	if res != 0 {
+		log.Debugf("stderr: %s", string(stderr))
+		return nil, fmt.Errorf("non-zero listing %s: %d", f.source, res)
+	}
+
+	var files []*remoteFile
+	for _, record := range nulRecords(out) {
+		fields := strings.SplitN(record, " ", 3)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("unexpected listing of %s: %q", f.source, record)
+		}
+		mode, err := strconv.ParseUint(fields[0], 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("parsing mode of %s: %s", fields[2], err)
+		}
+		files = append(files, &remoteFile{path: fields[2], mode: os.FileMode(mode).Perm(), hash: fields[1]})
+	}
+	return files, nil
+}
+
+// fileHash returns the hex sha256 of a local file, or "" if it doesn't exist.
+func fileHash(path string) (string, error) {
+	in, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, in); err != nil {
+		return "", fmt.Errorf("reading %s: %s", path, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// get copies rf to local, via a temporary file that is only renamed into place once its checksum is verified.
+func get(tr transport.Transport, rf *remoteFile, local string) error {
+	if err := os.MkdirAll(filepath.Dir(local), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(local), "."+filepath.Base(local)+".gosible-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if err := tmp.Chmod(rf.mode); err != nil {
+		return err
+	}
+	h := sha256.New()
+	if err := tr.Get(rf.path, io.MultiWriter(tmp, h)); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != rf.hash {
+		return fmt.Errorf("transfer of %s corrupted: sha256 %s, expected %s", rf.path, got, rf.hash)
+	}
+	return os.Rename(tmp.Name(), local)
+}
+
+func (f *Fetch) Execute(target *types.Target, tr transport.Transport) (bool, error) {
+	files, err := f.list(tr)
+	if err != nil {
+		return false, err
+	}
+	if len(files) == 0 {
+		log.Warningf("fetch: no files found at %s on %s", f.source, target.Name)
+	}
+
+	base := filepath.Join(f.dest, target.Name)
+	var fetched []string
+	for _, rf := range files {
+		local := filepath.Join(base, rf.path)
+		if !strings.HasPrefix(local, base+"/") {
+			return false, fmt.Errorf("fetch: %s would be stored outside of %s", rf.path, base)
+		}
+		have, err := fileHash(local)
+		if err != nil {
+			return false, err
+		}
+		if have == rf.hash {
+			log.Debugf("%s already has sha256 %s", local, have)
+			continue
+		}
+
+		if err := get(tr, rf, local); err != nil {
+			return false, fmt.Errorf("fetching %s to %s: %s", rf.path, local, err)
+		}
+		log.Infof("fetched %s to %s", rf.path, local)
+		fetched = append(fetched, local)
+	}
+
+	registerResult(target, f.register, "changed", strings.Join(fetched, "\n"))
+	return len(fetched) > 0, nil
+}
+
+func (*Fetch) Name() string { return "fetch" }
+func (*Fetch) Always() bool { return false }
+
+var _ Module = (*Fetch)(nil)
@@ -2,23 +2,44 @@ package module
 
 import (
 	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"github.com/pdbogen/gosible/transport"
 	"github.com/pdbogen/gosible/types"
 	"io"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 )
 
 type File struct {
-	source  *string
-	literal *string
-	dest    string
-	mode    *int32
-	uid     *int32
-	gid     *int32
+	state     string
+	source    *string
+	literal   *string
+	dest      string
+	mode      *fileMode
+	owner     string
+	group     string
+	uid       *int32
+	gid       *int32
+	validate  string
+	backup    bool
+	backupDir string
+	register  string
+	recurse   bool
+	// follow writes through a symlink at dest, rather than replacing it with a file.
+	follow bool
+	// linkTarget is what a link or hard link at dest should point to.
+	linkTarget string
+
+	// backupPath is where the previous content was saved by the last Execute, if anywhere.
+	backupPath string
 }
 
 func check(path string) error {
@@ -37,7 +58,16 @@ func int32Ptr(i int32) (ret *int32) {
 }
 
 func (f *File) Configure(target *types.Target, params map[string]string) error {
-	*f = File{}
+	*f = File{state: stateFile, follow: true}
+	if state, ok := params["state"]; ok {
+		switch state {
+		case stateFile, stateAbsent, stateDirectory, stateLink, stateHard, stateTouch:
+			f.state = state
+		default:
+			return fmt.Errorf("file: unknown state %s", state)
+		}
+	}
+
 	src, srcOk := params["source"]
 	if srcOk {
 		if src[0] != '/' {
@@ -49,7 +79,11 @@ func (f *File) Configure(target *types.Target, params map[string]string) error {
 	}
 
 	lit, litOk := params["literal"]
-	if litOk && srcOk {
+	if f.state != stateFile {
+		if litOk || srcOk {
+			return fmt.Errorf("file: source and literal cannot be used with state %s", f.state)
+		}
+	} else if litOk && srcOk {
 		return errors.New("file configured with both source and literal")
 	} else if !litOk && !srcOk {
 		return errors.New("file configured with neither source nor literal")
@@ -57,45 +91,176 @@ func (f *File) Configure(target *types.Target, params map[string]string) error {
 
 	if srcOk {
 		f.source = &src
-	} else {
+	} else if litOk {
 		f.literal = &lit
 	}
 
+	if linkTarget, ok := params["target"]; ok {
+		if f.state != stateLink && f.state != stateHard {
+			return fmt.Errorf("file: target can only be used with state link or hard")
+		}
+		f.linkTarget = linkTarget
+	} else if f.state == stateLink || f.state == stateHard {
+		return fmt.Errorf("file: state %s requires a target", f.state)
+	}
+
+	if recurse, ok := params["recurse"]; ok {
+		r, err := strconv.ParseBool(recurse)
+		if err != nil {
+			return fmt.Errorf("parsing recurse %s: %s", recurse, err)
+		}
+		if r && f.state != stateDirectory {
+			return errors.New("file: recurse can only be used with state directory")
+		}
+		f.recurse = r
+	}
+
+	if follow, ok := params["follow"]; ok {
+		b, err := strconv.ParseBool(follow)
+		if err != nil {
+			return fmt.Errorf("parsing follow %s: %s", follow, err)
+		}
+		f.follow = b
+	}
+
 	if dst, ok := params["dest"]; !ok {
 		return errors.New("file configured without destination")
 	} else {
 		f.dest = dst
 	}
 
+	if validate, ok := params["validate"]; ok {
+		if !strings.Contains(validate, "%s") {
+			return fmt.Errorf("validate command %q does not contain %%s", validate)
+		}
+		f.validate = validate
+	}
+
+	if backup, ok := params["backup"]; ok {
+		b, err := strconv.ParseBool(backup)
+		if err != nil {
+			return fmt.Errorf("parsing backup %s: %s", backup, err)
+		}
+		f.backup = b
+	}
+	f.backupDir = params["backup_dir"]
+	f.register = params["register"]
+
 	if mode, ok := params["mode"]; ok {
-		if n, err := strconv.ParseInt(mode, 8, 16); err != nil {
-			return fmt.Errorf("parsing (non-octal?) mode %s: %s", mode, err)
-		} else {
-			f.mode = int32Ptr(int32(n))
+		m, err := parseMode(mode)
+		if err != nil {
+			return fmt.Errorf("parsing mode %s: %s", mode, err)
 		}
+		f.mode = m
 	}
 
-	if uid, ok := params["uid"]; ok {
-		if n, err := strconv.Atoi(uid); err != nil {
+	// owner and group may be names, which are looked up on the target; uid and gid are their older, numeric-only
+	// spellings.
+	if owner, ok := params["owner"]; ok {
+		f.owner = owner
+	} else if uid, ok := params["uid"]; ok {
+		if _, err := strconv.Atoi(uid); err != nil {
 			return fmt.Errorf("parsing (non-numeric?) UID %s: %s", uid, err)
-		} else {
-			f.uid = int32Ptr(int32(n))
 		}
+		f.owner = uid
 	}
 
-	if gid, ok := params["gid"]; ok {
-		if n, err := strconv.Atoi(gid); err != nil {
+	if group, ok := params["group"]; ok {
+		f.group = group
+	} else if gid, ok := params["gid"]; ok {
+		if _, err := strconv.Atoi(gid); err != nil {
 			return fmt.Errorf("parsing (non-numeric?) GID %s: %s", gid, err)
-		} else {
-			f.gid = int32Ptr(int32(n))
 		}
+		f.group = gid
 	}
 
 	return nil
 }
 
-func (f *File) writeFile(tr transport.Transport) (bool, error) {
-	var changed bool
+// resolveOwner looks up the configured owner and group on the target, setting uid and gid.
+func (f *File) resolveOwner(tr transport.Transport) error {
+	f.uid, f.gid = nil, nil
+	if f.owner != "" {
+		uid, err := lookupUser(tr, f.owner)
+		if err != nil {
+			return err
+		}
+		f.uid = int32Ptr(int32(uid))
+	}
+	if f.group != "" {
+		gid, err := lookupGroup(tr, f.group)
+		if err != nil {
+			return err
+		}
+		f.gid = int32Ptr(int32(gid))
+	}
+	return nil
+}
+
+// hash returns the hex sha256 of the file at path on the target, or "" if it doesn't exist. The file is read from stdin,
+// as sha256sum escapes a name with a backslash or newline in it and marks that by prefixing the hash with a backslash.
+func hash(tr transport.Transport, path string) (string, error) {
+	out, _, res, err := tr.Do([]string{"sh", "-c", `sha256sum < "$1"`, "sh", path})
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Fields(string(out))
+	if res != 0 || len(fields) == 0 {
+		return "", nil
+	}
+	return fields[0], nil
+}
+
+// tempName returns a name for a temporary file next to path, so that it's on the same filesystem and can be renamed
+// over path atomically.
+func tempName(path string) (string, error) {
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	dir, base := filepath.Split(path)
+	return fmt.Sprintf("%s.%s.gosible-%s", dir, base, hex.EncodeToString(suffix)), nil
+}
+
+// localHash returns the hex sha256 of the configured content.
+func (f *File) localHash() (string, error) {
+	h := sha256.New()
+	if f.literal != nil {
+		h.Write([]byte(*f.literal))
+	} else {
+		source_file, err := os.Open(*f.source)
+		if err != nil {
+			return "", fmt.Errorf("opening source %s: %s", *f.source, err)
+		}
+		defer source_file.Close()
+		if _, err := io.Copy(h, source_file); err != nil {
+			return "", fmt.Errorf("reading source %s: %s", *f.source, err)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// writeFile compares the content's hash against the destination's, and transfers nothing if they match. Otherwise,
+// the content is staged in a temporary file next to the destination; its mode and ownership are set (as configured,
+// or else copied from the previous file); and it's renamed into place. So the destination is never missing or
+// partially written. prev is the destination's stat, or nil if it doesn't exist.
+func (f *File) writeFile(tr transport.Transport, prev *fileStat) (changed bool, err error) {
+	want, err := f.localHash()
+	if err != nil {
+		return false, err
+	}
+
+	if prev != nil {
+		prevHash, err := hash(tr, f.dest)
+		if err != nil {
+			return false, fmt.Errorf("error checking file pre content: %s", err)
+		}
+		if prevHash == want {
+			log.Debugf("%s already has sha256 %s", f.dest, want)
+			return false, nil
+		}
+	}
+
 	var src io.Reader
 	if f.literal != nil {
 		src = bytes.NewBufferString(*f.literal)
@@ -108,110 +273,305 @@ func (f *File) writeFile(tr transport.Transport) (bool, error) {
 		src = source_file
 	}
 
-	prevHash, _, _, err := tr.Do([]string{"sha256sum", f.dest})
+	tmp, err := tempName(f.dest)
 	if err != nil {
-		return false, fmt.Errorf("error checking file pre content: %s", err)
+		return false, fmt.Errorf("choosing temporary file name: %s", err)
 	}
-	_, _, _, err = tr.Do([]string{"rm", "-f", f.dest})
+	renamed := false
+	defer func() {
+		if !renamed {
+			if _, _, _, rmErr := tr.Do([]string{"rm", "-f", tmp}); rmErr != nil {
+				log.Warningf("removing temporary file %s: %s", tmp, rmErr)
+			}
+		}
+	}()
+
+	if err := tr.Put(tmp, src, 0600); err != nil {
+		return false, fmt.Errorf("writing: %s", err)
+	}
+
+	postHash, err := hash(tr, tmp)
 	if err != nil {
-		return false, fmt.Errorf("clearing previous file: %s", err)
+		return false, fmt.Errorf("error checking file post content: %s", err)
 	}
-	_, _, res, err := tr.DoReader([]string{"tee", f.dest}, src)
+	if postHash != want {
+		return false, fmt.Errorf("transfer to %s corrupted: sha256 %s, expected %s", tmp, postHash, want)
+	}
+
+	if err := f.applyAttrs(tr, tmp, prev); err != nil {
+		return false, err
+	}
+
+	if err := validate(tr, f.validate, tmp); err != nil {
+		return false, err
+	}
+
+	if f.backup && prev != nil {
+		path, err := backup(tr, f.dest, f.backupDir)
+		if err != nil {
+			return false, err
+		}
+		f.backupPath = path
+	}
+
+	_, stderr, res, err := tr.Do([]string{"mv", "-f", tmp, f.dest})
 	if err != nil {
-		return false, fmt.Errorf("writing: %s", err)
+		return false, fmt.Errorf("renaming %s to %s: %s", tmp, f.dest, err)
 	}
 	if res != 0 {
-		return false, fmt.Errorf("non-zero writing: %d", res)
+		log.Debugf("stderr: %s", string(stderr))
+		return false, fmt.Errorf("non-zero renaming %s to %s: %d", tmp, f.dest, res)
+	}
+	renamed = true
+	return true, nil
+}
+
+// shellQuote quotes s for use as a single word in a shell command.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// validate runs the given command, with %s replaced by path, and fails if it exits non-zero. An empty command
+// always succeeds.
+func validate(tr transport.Transport, command, path string) error {
+	if command == "" {
+		return nil
 	}
 
-	postHash, _, _, err := tr.Do([]string{"sha256sum", f.dest})
+	cmd := strings.Replace(command, "%s", shellQuote(path), -1)
+	stdout, stderr, res, err := tr.Do([]string{"sh", "-c", cmd})
 	if err != nil {
-		return false, fmt.Errorf("error checking file post content: %s", err)
+		return fmt.Errorf("running validation %s: %s", cmd, err)
 	}
-	if (prevHash == nil && postHash != nil) ||
-		(prevHash != nil && postHash != nil && !bytes.Equal(prevHash, postHash)) {
-		changed = true
+	if res != 0 {
+		for _, out := range [][]byte{stdout, stderr} {
+			for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+				if line != "" {
+					log.Warningf("validate: %s", line)
+				}
+			}
+		}
+		return fmt.Errorf("validation %s failed: %d", cmd, res)
 	}
-	return changed, nil
+	return nil
 }
 
-func (f *File) setMode(tr transport.Transport) (bool, error) {
-	if f.mode != nil {
-		prevMode, _, _, err := tr.Do([]string{"stat", "-c", "%a", f.dest})
+// backupScript copies $1, preserving mode and ownership, to $2~; or, if that's taken, to the first of $2.1~, $2.2~,
+// and so on that isn't. It prints the name it used.
+const backupScript = `name="$2" n=0
+while [ -e "$name~" ] || [ -L "$name~" ]; do n=$((n + 1)); name="$2.$n"; done
+cp -p "$1" "$name~" && echo "$name~"`
+
+// backup copies the file at path, preserving mode and ownership, to a timestamped name; either next to it, or in dir
+// if that's given. Backups made within the same second get a counter, so none is overwritten. It returns the path of
+// the copy.
+func backup(tr transport.Transport, path, dir string) (string, error) {
+	name := path
+	if dir != "" {
+		_, stderr, res, err := tr.Do([]string{"mkdir", "-p", dir})
 		if err != nil {
-			return false, fmt.Errorf("checking file mode: %s", err)
+			return "", fmt.Errorf("creating backup directory %s: %s", dir, err)
 		}
-		log.Debugf("prev mode: %s", string(prevMode))
-		prevModeVal, err := strconv.ParseInt(strings.TrimSpace(string(prevMode)), 8, 16)
-		if err != nil {
-			log.Warningf("error parsing previous mode: %s", err)
+		if res != 0 {
+			log.Debugf("stderr: %s", string(stderr))
+			return "", fmt.Errorf("non-zero creating backup directory %s: %d", dir, res)
 		}
-		if prevModeVal == int64(*f.mode) {
+		name = strings.TrimRight(dir, "/") + "/" + filepath.Base(path)
+	}
+	name += "." + time.Now().Format("2006-01-02@15:04:05")
+
+	out, stderr, res, err := tr.Do([]string{"sh", "-c", backupScript, "sh", path, name})
+	if err != nil {
+		return "", fmt.Errorf("backing up %s to %s~: %s", path, name, err)
+	}
+	if res != 0 {
+		log.Debugf("stderr: %s", string(stderr))
+		return "", fmt.Errorf("non-zero backing up %s to %s~: %d", path, name, res)
+	}
+	name = strings.TrimSpace(string(out))
+	log.Infof("backed up %s to %s", path, name)
+	return name, nil
+}
+
+// recordBackup notes the backup path, if a backup was made, in the target's metadata as <register>_backup, so that
+// later tasks can find it.
+func recordBackup(target *types.Target, register, path string) {
+	if path != "" {
+		registerResult(target, register, "backup", path)
+	}
+}
+
+// applyAttrs sets the mode and ownership of the staged file at path: as configured, or else as they were on the
+// previous file. A brand-new file with no configured mode gets 0644.
+func (f *File) applyAttrs(tr transport.Transport, path string, prev *fileStat) error {
+	mode := int64(0644)
+	if prev != nil {
+		mode = prev.mode
+	}
+	if f.mode != nil {
+		mode = f.mode.apply(mode, false)
+	}
+	_, stderr, res, err := tr.Do([]string{"chmod", fmt.Sprintf("%04o", mode), path})
+	if err != nil {
+		return fmt.Errorf("setting mode %04o on %s: %s", mode, path, err)
+	}
+	if res != 0 {
+		log.Debugf("stderr: %s", string(stderr))
+		return fmt.Errorf("non-zero setting mode %04o on %s: %d", mode, path, res)
+	}
+
+	owner := ""
+	if f.uid != nil {
+		owner = strconv.Itoa(int(*f.uid))
+	} else if prev != nil {
+		owner = strconv.Itoa(prev.uid)
+	}
+	if f.gid != nil {
+		owner += ":" + strconv.Itoa(int(*f.gid))
+	} else if prev != nil {
+		owner += ":" + strconv.Itoa(prev.gid)
+	}
+	if owner == "" {
+		return nil
+	}
+	_, stderr, res, err = tr.Do([]string{"chown", owner, path})
+	if err != nil {
+		return fmt.Errorf("setting owner %s on %s: %s", owner, path, err)
+	}
+	if res != 0 {
+		log.Debugf("stderr: %s", string(stderr))
+		return fmt.Errorf("non-zero setting owner %s on %s: %d", owner, path, res)
+	}
+	return nil
+}
+
+// fileStat is the subset of stat(1) output that File cares about.
+type fileStat struct {
+	kind int64 // the S_IFMT bits: regular file, directory, symlink, ...
+	mode int64
+	uid  int
+	gid  int
+}
+
+func (st *fileStat) isDir() bool  { return st.kind == syscall.S_IFDIR }
+func (st *fileStat) isLink() bool { return st.kind == syscall.S_IFLNK }
+
+// parseStat parses the fields of `stat -c "%f %u %g"` output.
+func parseStat(fields []string) (*fileStat, error) {
+	raw, err := strconv.ParseInt(fields[0], 16, 32)
+	if err != nil {
+		return nil, fmt.Errorf("parsing previous mode: %s", err)
+	}
+	st := &fileStat{kind: raw & syscall.S_IFMT, mode: raw & 07777}
+	if st.uid, err = strconv.Atoi(fields[1]); err != nil {
+		return nil, fmt.Errorf("parsing previous UID: %s", err)
+	}
+	if st.gid, err = strconv.Atoi(fields[2]); err != nil {
+		return nil, fmt.Errorf("parsing previous GID: %s", err)
+	}
+	return st, nil
+}
+
+// stat retrieves type, mode and ownership of the destination in a single command, rather than one per attribute.
+// A symlink is described itself, rather than what it points to. It returns nil if the destination doesn't exist.
+func (f *File) stat(tr transport.Transport) (*fileStat, error) {
+	out, stderr, res, err := tr.Do([]string{
+		"sh", "-c", `if [ -e "$1" ] || [ -L "$1" ]; then exec stat -c "%f %u %g" "$1"; fi`, "sh", f.dest,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("checking file mode and owner: %s", err)
+	}
+	if res != 0 {
+		log.Debugf("stderr: %s", string(stderr))
+		return nil, fmt.Errorf("non-zero checking mode and owner of %s: %d", f.dest, res)
+	}
+
+	fields := strings.Fields(string(out))
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("unexpected stat output for %s: %q", f.dest, string(out))
+	}
+	st, err := parseStat(fields)
+	if err != nil {
+		return nil, err
+	}
+	log.Debugf("previous type/mode/uid/gid of %s: %o/%04o/%d/%d", f.dest, st.kind, st.mode, st.uid, st.gid)
+	return st, nil
+}
+
+// followLink points dest at the file that a symlink at dest leads to, if follow is set, so that the file is written
+// rather than the link replaced; as for /etc/resolv.conf, which is often a link into /run. It returns the stat of that
+// file, or nil if it doesn't exist yet. prev is the stat of dest, which is returned as it is if dest isn't a link.
+func (f *File) followLink(tr transport.Transport, prev *fileStat) (*fileStat, error) {
+	if prev == nil || !prev.isLink() || !f.follow {
+		return prev, nil
+	}
+	out, err := run(tr, "resolving link "+f.dest, "readlink", "-f", f.dest)
+	if err != nil {
+		return nil, err
+	}
+	resolved := strings.TrimSpace(string(out))
+	log.Debugf("%s is a link to %s", f.dest, resolved)
+	f.dest = resolved
+	return f.stat(tr)
+}
+
+// setMode sets the configured mode on the destination, if it doesn't have it already. Symlinks have no mode of their
+// own, so they're left alone.
+func (f *File) setMode(tr transport.Transport, st *fileStat) (bool, error) {
+	if f.mode != nil && !st.isLink() {
+		mode := f.mode.apply(st.mode, st.isDir())
+		if st.mode == mode {
 			return false, nil
 		}
-		_, stderr, res, err := tr.Do([]string{"chmod", fmt.Sprintf("%04o", *f.mode), f.dest})
+		_, stderr, res, err := tr.Do([]string{"chmod", fmt.Sprintf("%04o", mode), f.dest})
 		if err != nil {
-			return false, fmt.Errorf("setting mode %04o on %s: %s", *f.mode, f.dest, err)
+			return false, fmt.Errorf("setting mode %04o on %s: %s", mode, f.dest, err)
 		}
 		if res != 0 {
-			log.Debugf("non-zero setting mod %04o on %s: %d", *f.mode, f.dest, res)
+			log.Debugf("non-zero setting mod %04o on %s: %d", mode, f.dest, res)
 			log.Debugf("stderr: %s", string(stderr))
-			return false, fmt.Errorf("non-zero setting mode %04o on %s: %d", *f.mode, f.dest, res)
+			return false, fmt.Errorf("non-zero setting mode %04o on %s: %d", mode, f.dest, res)
 		}
 		return true, nil
 	}
 	return false, nil
 }
 
-func (f *File) setUid(tr transport.Transport) (bool, error) {
+func (f *File) setUid(tr transport.Transport, st *fileStat) (bool, error) {
 	if f.uid != nil {
-		prevUid, _, _, err := tr.Do([]string{"stat", "-c", "%u", f.dest})
-		if err != nil {
-			return false, fmt.Errorf("checking file owner: %s", err)
-		}
-		prevUidVal, err := strconv.Atoi(strings.TrimSpace(string(prevUid)))
-		if err != nil {
-			log.Warningf("failed parsing previous UID: %s", err)
-		}
-		log.Debugf("previous UID: %d", prevUidVal)
-		if prevUidVal == int(*f.uid) {
+		if st.uid == int(*f.uid) {
 			return false, nil
 		}
-		_, stderr, res, err := tr.Do([]string{"chown", strconv.Itoa(int(*f.uid)), f.dest})
+		_, stderr, res, err := tr.Do([]string{"chown", "-h", strconv.Itoa(int(*f.uid)), f.dest})
 		if err != nil {
 			return false, fmt.Errorf("setting uid %d on %s: %s", *f.uid, f.dest, err)
 		}
 		if res != 0 {
 			log.Debugf("non-zero setting uid %d on %s: %d", *f.uid, f.dest, res)
 			log.Debugf("stderr: %s", string(stderr))
-			return false, fmt.Errorf("non-zero setting uid %s on %s: %d", *f.uid, f.dest, res)
+			return false, fmt.Errorf("non-zero setting uid %d on %s: %d", *f.uid, f.dest, res)
 		}
 		return true, nil
 	}
 	return false, nil
 }
 
-func (f *File) setGid(tr transport.Transport) (bool, error) {
+func (f *File) setGid(tr transport.Transport, st *fileStat) (bool, error) {
 	if f.gid != nil {
-		prevGid, _, _, err := tr.Do([]string{"stat", "-c", "%g", f.dest})
-		if err != nil {
-			return false, fmt.Errorf("checking file owner: %s", err)
-		}
-		prevGidVal, err := strconv.Atoi(strings.TrimSpace(string(prevGid)))
-		if err != nil {
-			log.Warningf("error parsing previous GID: %s", err)
-		}
-		if prevGidVal == int(*f.gid) {
+		if st.gid == int(*f.gid) {
 			return false, nil
 		}
-		_, stderr, res, err := tr.Do([]string{"chown", ":" + strconv.Itoa(int(*f.gid)), f.dest})
+		_, stderr, res, err := tr.Do([]string{"chown", "-h", ":" + strconv.Itoa(int(*f.gid)), f.dest})
 		if err != nil {
 			return false, fmt.Errorf("setting gid %d on %s: %s", *f.gid, f.dest, err)
 		}
 		if res != 0 {
 			log.Debugf("non-zero setting gid %d on %s: %d", *f.gid, f.dest, res)
 			log.Debugf("stderr: %s", string(stderr))
-			return false, fmt.Errorf("non-zero setting gid %s on %s: %d", *f.gid, f.dest, res)
+			return false, fmt.Errorf("non-zero setting gid %d on %s: %d", *f.gid, f.dest, res)
 		}
 		return true, nil
 	}
@@ -219,25 +579,88 @@ func (f *File) setGid(tr transport.Transport) (bool, error) {
 }
 
 func (f *File) Execute(target *types.Target, tr transport.Transport) (bool, error) {
-	changed, err := f.writeFile(tr)
+	prev, err := f.stat(tr)
+	if err != nil {
+		return false, err
+	}
+
+	if err := f.resolveOwner(tr); err != nil {
+		return false, err
+	}
+
+	var changed bool
+	switch f.state {
+	case stateAbsent:
+		return f.remove(tr, prev)
+	case stateDirectory:
+		changed, err = f.directory(tr, prev)
+	case stateLink, stateHard:
+		changed, err = f.link(tr, prev)
+	case stateTouch:
+		changed, err = f.touch(tr, prev)
+	default:
+		if prev, err = f.followLink(tr, prev); err != nil {
+			return false, err
+		}
+		if prev != nil && prev.isLink() {
+			log.Infof("replacing link %s with a file", f.dest)
+			prev = nil
+		} else if prev != nil && prev.kind != syscall.S_IFREG {
+			return false, fmt.Errorf("%s exists, and is not a regular file", f.dest)
+		}
+		f.backupPath = ""
+		changed, err = f.writeFile(tr, prev)
+		if err != nil {
+			return false, err
+		}
+		recordBackup(target, f.register, f.backupPath)
+		log.Debugf("file %s on %s content change => %t", f.dest, target.Name, changed)
+
+		// A replaced file got its mode and ownership before it was renamed into place; only an unchanged file still
+		// needs them checked.
+		if changed {
+			return true, nil
+		}
+	}
 	if err != nil {
 		return false, err
 	}
-	log.Debugf("file %s on %s content change => %t", f.dest, target.Name, changed)
+	if f.mode == nil && f.uid == nil && f.gid == nil {
+		return changed, nil
+	}
+
+	// Something new was created at dest, so look at it again.
+	if changed {
+		if prev, err = f.stat(tr); err != nil {
+			return false, err
+		}
+		if prev == nil {
+			return false, fmt.Errorf("%s is missing after creating it", f.dest)
+		}
+	}
+
+	if f.recurse {
+		attrsChanged, err := f.setAttrsRecursive(tr)
+		if err != nil {
+			return false, err
+		}
+		log.Debugf("file %s on %s recursive mode/owner change => %t", f.dest, target.Name, attrsChanged)
+		return changed || attrsChanged, nil
+	}
 
-	modeChanged, err := f.setMode(tr)
+	modeChanged, err := f.setMode(tr, prev)
 	if err != nil {
 		return false, err
 	}
 	log.Debugf("file %s on %s mode change => %t", f.dest, target.Name, modeChanged)
 
-	uidChanged, err := f.setUid(tr)
+	uidChanged, err := f.setUid(tr, prev)
 	if err != nil {
 		return false, err
 	}
 	log.Debugf("file %s on %s UID change => %t", f.dest, target.Name, uidChanged)
 
-	gidChanged, err := f.setGid(tr)
+	gidChanged, err := f.setGid(tr, prev)
 	if err != nil {
 		return false, err
 	}
@@ -0,0 +1,205 @@
+package module
+
+import (
+	"fmt"
+	"github.com/pdbogen/gosible/transport"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The states File can put dest into.
+const (
+	stateFile      = "file"
+	stateAbsent    = "absent"
+	stateDirectory = "directory"
+	stateLink      = "link"
+	stateHard      = "hard"
+	stateTouch     = "touch"
+)
+
+// remove deletes dest, and everything under it if it's a directory.
+func (f *File) remove(tr transport.Transport, prev *fileStat) (bool, error) {
+	if prev == nil {
+		return false, nil
+	}
+	if _, err := run(tr, "removing "+f.dest, "rm", "-rf", f.dest); err != nil {
+		return false, err
+	}
+	log.Infof("removed %s", f.dest)
+	return true, nil
+}
+
+// directory creates dest, along with any missing parents, unless it's already a directory.
+func (f *File) directory(tr transport.Transport, prev *fileStat) (bool, error) {
+	if prev != nil {
+		if !prev.isDir() {
+			return false, fmt.Errorf("%s exists, and is not a directory", f.dest)
+		}
+		return false, nil
+	}
+	if _, err := run(tr, "creating directory "+f.dest, "mkdir", "-p", f.dest); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// touch creates dest as an empty file if it doesn't exist. An existing dest is left as it is, timestamps included, so
+// that touch doesn't report a change on every run.
+func (f *File) touch(tr transport.Transport, prev *fileStat) (bool, error) {
+	if prev != nil {
+		return false, nil
+	}
+	if _, err := run(tr, "creating "+f.dest, "touch", f.dest); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// link makes dest a symlink (or, for state hard, a hard link) to linkTarget, replacing whatever file or link is there
+// already. A directory is never replaced.
+func (f *File) link(tr transport.Transport, prev *fileStat) (bool, error) {
+	if prev != nil {
+		if prev.isDir() {
+			return false, fmt.Errorf("%s exists, and is a directory", f.dest)
+		}
+		same, err := f.linked(tr, prev)
+		if err != nil {
+			return false, err
+		}
+		if same {
+			return false, nil
+		}
+	}
+
+	cmd := []string{"ln", "-fn", f.linkTarget, f.dest}
+	if f.state == stateLink {
+		cmd = []string{"ln", "-sfn", f.linkTarget, f.dest}
+	}
+	if _, err := run(tr, fmt.Sprintf("linking %s to %s", f.dest, f.linkTarget), cmd...); err != nil {
+		return false, err
+	}
+	log.Infof("linked %s to %s", f.dest, f.linkTarget)
+	return true, nil
+}
+
+// linked reports whether dest, as described by prev, is already the link that's wanted: a symlink whose content is
+// linkTarget, or the same inode as linkTarget.
+func (f *File) linked(tr transport.Transport, prev *fileStat) (bool, error) {
+	if f.state == stateLink {
+		if !prev.isLink() {
+			return false, nil
+		}
+		out, err := run(tr, "reading link "+f.dest, "readlink", f.dest)
+		if err != nil {
+			return false, err
+		}
+		return strings.TrimRight(string(out), "\n") == f.linkTarget, nil
+	}
+
+	if prev.isLink() {
+		return false, nil
+	}
+	out, err := run(tr, "checking link target "+f.linkTarget, "stat", "-c", "%d:%i", f.linkTarget, f.dest)
+	if err != nil {
+		return false, err
+	}
+	inodes := strings.Fields(string(out))
+	return len(inodes) == 2 && inodes[0] == inodes[1], nil
+}
+
+// setAttrsRecursive sets the configured mode and ownership on dest and everything under it, touching only the entries
+// that don't have them already. As with setMode, symlinks get ownership but no mode.
+func (f *File) setAttrsRecursive(tr transport.Transport) (bool, error) {
+	// Each entry is printed as "<mode> <uid> <gid> <path>\0". stat runs once per path, as its own output can't be
+	// NUL-terminated everywhere: BusyBox's lacks --printf.
+	out, err := run(tr, "listing "+f.dest, "find", f.dest, "-exec", "sh", "-c",
+		`for p; do s=$(stat -c "%f %u %g" "$p") || exit 1; printf "%s %s\0" "$s" "$p"; done`, "sh", "{}", "+")
+	if err != nil {
+		return false, err
+	}
+
+	changes := newAttrChanges()
+	for _, line := range nulRecords(out) {
+		fields := strings.SplitN(line, " ", 4)
+		if len(fields) != 4 {
+			return false, fmt.Errorf("unexpected stat output under %s: %q", f.dest, line)
+		}
+		st, err := parseStat(fields[:3])
+		if err != nil {
+			return false, fmt.Errorf("%s: %s", fields[3], err)
+		}
+
+		mode := st.mode
+		if f.mode != nil {
+			mode = f.mode.apply(st.mode, st.isDir())
+		}
+		changes.add(fields[3], st, mode, f.uid, f.gid)
+	}
+	return changes.apply(tr, f.dest)
+}
+
+// attrChanges collects the chmods and chowns needed across many paths, grouped by the mode or owner being set, so
+// that they take as few commands as possible.
+type attrChanges struct {
+	chmods map[string][]string
+	chowns map[string][]string
+}
+
+func newAttrChanges() *attrChanges {
+	return &attrChanges{chmods: map[string][]string{}, chowns: map[string][]string{}}
+}
+
+// add notes whatever it takes to get path, currently as described by st, to the given mode; and to uid and gid, if
+// they're given. st is nil for a path that was only just created, so that its attributes aren't known. Symlinks have
+// no mode of their own, so only their ownership is changed. add reports whether anything needs changing.
+func (a *attrChanges) add(path string, st *fileStat, mode int64, uid, gid *int32) bool {
+	noted := false
+	if st == nil || (mode != st.mode && !st.isLink()) {
+		key := fmt.Sprintf("%04o", mode)
+		a.chmods[key] = append(a.chmods[key], path)
+		noted = true
+	}
+
+	owner := ""
+	if uid != nil && (st == nil || int(*uid) != st.uid) {
+		owner = strconv.Itoa(int(*uid))
+	}
+	if gid != nil && (st == nil || int(*gid) != st.gid) {
+		owner += ":" + strconv.Itoa(int(*gid))
+	}
+	if owner != "" {
+		a.chowns[owner] = append(a.chowns[owner], path)
+		noted = true
+	}
+	return noted
+}
+
+// apply runs the collected chmods and chowns, and reports whether there were any. under describes where the paths
+// are, for error messages.
+func (a *attrChanges) apply(tr transport.Transport, under string) (bool, error) {
+	changed := false
+	for _, batch := range []struct {
+		cmd  []string
+		byTo map[string][]string
+	}{
+		{[]string{"chmod"}, a.chmods},
+		{[]string{"chown", "-h"}, a.chowns},
+	} {
+		keys := make([]string, 0, len(batch.byTo))
+		for key := range batch.byTo {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			what := fmt.Sprintf("running %s %s under %s", batch.cmd[0], key, under)
+			cmd := append(append([]string{}, batch.cmd...), key)
+			if err := runBatched(tr, what, batch.byTo[key], cmd...); err != nil {
+				return false, err
+			}
+			changed = true
+		}
+	}
+	return changed, nil
+}
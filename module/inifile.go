@@ -0,0 +1,181 @@
+package module
+
+import (
+	"errors"
+	"fmt"
+	"github.com/pdbogen/gosible/transport"
+	"github.com/pdbogen/gosible/types"
+	"strconv"
+	"strings"
+)
+
+// IniFile sets or removes a single key in an INI-style file on the target, leaving comments, formatting and every
+// other key and section as they were.
+type IniFile struct {
+	editor
+	section      string
+	option       string
+	value        string
+	absent       bool
+	noExtraSpace bool
+}
+
+func (i *IniFile) Configure(_ *types.Target, params map[string]string) error {
+	*i = IniFile{}
+	if err := i.editor.configure("ini_file", params); err != nil {
+		return err
+	}
+
+	switch params["state"] {
+	case "", "present":
+	case "absent":
+		i.absent = true
+	default:
+		return fmt.Errorf("ini_file: unknown state %s", params["state"])
+	}
+
+	i.section = strings.TrimSpace(params["section"])
+	if option, ok := params["option"]; !ok || strings.TrimSpace(option) == "" {
+		return errors.New("ini_file configured without option")
+	} else {
+		i.option = strings.TrimSpace(option)
+	}
+
+	if value, ok := params["value"]; ok {
+		i.value = strings.TrimSpace(value)
+	} else if !i.absent {
+		return errors.New("ini_file configured without value")
+	}
+
+	if nes, ok := params["no_extra_spaces"]; ok {
+		b, err := strconv.ParseBool(nes)
+		if err != nil {
+			return fmt.Errorf("parsing no_extra_spaces %s: %s", nes, err)
+		}
+		i.noExtraSpace = b
+	}
+	return nil
+}
+
+// iniSection returns the name of the section that line starts, if it's a section header.
+func iniSection(line string) (string, bool) {
+	line = strings.TrimSpace(line)
+	if len(line) < 2 || line[0] != '[' || line[len(line)-1] != ']' {
+		return "", false
+	}
+	return strings.TrimSpace(line[1 : len(line)-1]), true
+}
+
+// iniKey parses line as a key = value pair. Comments, blank lines and section headers aren't.
+func iniKey(line string) (key, value string, ok bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == ';' || line[0] == '#' || line[0] == '[' {
+		return "", "", false
+	}
+	kv := strings.SplitN(line, "=", 2)
+	if len(kv) != 2 {
+		return strings.TrimSpace(line), "", true
+	}
+	return strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1]), true
+}
+
+// iniValue parses a raw value from the file as it's compared: a quoted value is what's between the quotes; otherwise,
+// an inline comment, started by ; or # after whitespace, isn't part of it.
+func iniValue(raw string) string {
+	raw = strings.TrimSpace(raw)
+	if len(raw) > 0 && (raw[0] == '"' || raw[0] == '\'') {
+		if end := strings.IndexByte(raw[1:], raw[0]); end >= 0 {
+			return raw[1 : end+1]
+		}
+	}
+	for n := 1; n < len(raw); n++ {
+		if (raw[n] == ';' || raw[n] == '#') && (raw[n-1] == ' ' || raw[n-1] == '\t') {
+			return strings.TrimSpace(raw[:n])
+		}
+	}
+	return raw
+}
+
+// iniUnquote strips the quotes, if any, around the configured value; which, unlike one from the file, is taken to
+// have no comment.
+func iniUnquote(value string) string {
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		return value[1 : len(value)-1]
+	}
+	return value
+}
+
+func (i *IniFile) line() string {
+	if i.noExtraSpace {
+		return i.option + "=" + i.value
+	}
+	return i.option + " = " + i.value
+}
+
+// edit finds the section's lines: those after its header, up to the next header; or, for the unnamed section, those
+// before the first header. Within them, the first occurrence of the option is set, unless its value already parses the
+// same, and any later ones are removed; or, if there is none, the option is added after the section's last non-blank
+// line. A missing section is added at the end of the file. For state absent, every occurrence is removed instead.
+func (i *IniFile) edit(lines []string) ([]string, error) {
+	start, stop := -1, len(lines)
+	if i.section == "" {
+		start = 0
+	}
+	for n, line := range lines {
+		name, ok := iniSection(line)
+		if !ok {
+			continue
+		}
+		if start != -1 {
+			stop = n
+			break
+		}
+		if name == i.section {
+			start = n + 1
+		}
+	}
+
+	if start == -1 {
+		if i.absent {
+			return lines, nil
+		}
+		edited := append([]string{}, lines...)
+		if len(edited) > 0 && strings.TrimSpace(edited[len(edited)-1]) != "" {
+			edited = append(edited, "")
+		}
+		return append(edited, "["+i.section+"]", i.line()), nil
+	}
+
+	edited := append([]string{}, lines[:start]...)
+	found := false
+	last := len(edited) // where to add the option: after the last non-blank line of the section
+	for _, line := range lines[start:stop] {
+		if key, value, ok := iniKey(line); ok && key == i.option {
+			if i.absent || found {
+				continue
+			}
+			found = true
+			if iniValue(value) != iniUnquote(i.value) {
+				line = i.line()
+			}
+		}
+		edited = append(edited, line)
+		if strings.TrimSpace(line) != "" {
+			last = len(edited)
+		}
+	}
+
+	if !found && !i.absent {
+		edited = append(edited[:last], append([]string{i.line()}, edited[last:]...)...)
+	}
+	return append(edited, lines[stop:]...), nil
+}
+
+func (i *IniFile) Execute(target *types.Target, tr transport.Transport) (bool, error) {
+	return i.apply(target, tr, i.edit)
+}
+
+func (*IniFile) Name() string { return "ini_file" }
+func (*IniFile) Always() bool { return false }
+
+var _ Module = (*IniFile)(nil)
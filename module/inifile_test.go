@@ -0,0 +1,121 @@
+package module
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestIniFileEdit(t *testing.T) {
+	tests := []struct {
+		name   string
+		params map[string]string
+		lines  []string
+		want   []string
+	}{
+		{
+			"set in section",
+			map[string]string{"section": "PHP", "option": "memory_limit", "value": "256M"},
+			[]string{"[PHP]", "memory_limit = 128M", "", "[Other]", "memory_limit = 1M"},
+			[]string{"[PHP]", "memory_limit = 256M", "", "[Other]", "memory_limit = 1M"},
+		},
+		{
+			"same value differently spaced",
+			map[string]string{"section": "PHP", "option": "memory_limit", "value": "128M"},
+			[]string{"[PHP]", "memory_limit=128M"},
+			[]string{"[PHP]", "memory_limit=128M"},
+		},
+		{
+			"same value quoted",
+			map[string]string{"section": "a", "option": "k", "value": "v"},
+			[]string{"[a]", `k = "v"`},
+			[]string{"[a]", `k = "v"`},
+		},
+		{
+			"same value with a comment",
+			map[string]string{"section": "a", "option": "k", "value": "v"},
+			[]string{"[a]", "k = v ; the default", "j = w # why"},
+			[]string{"[a]", "k = v ; the default", "j = w # why"},
+		},
+		{
+			"quoted comment characters are part of the value",
+			map[string]string{"section": "a", "option": "k", "value": "x ; y"},
+			[]string{"[a]", `k = "x ; y"`},
+			[]string{"[a]", `k = "x ; y"`},
+		},
+		{
+			"added after the section's last line",
+			map[string]string{"section": "a", "option": "new", "value": "1", "no_extra_spaces": "true"},
+			[]string{"[a]", "k = v", "", "[b]"},
+			[]string{"[a]", "k = v", "new=1", "", "[b]"},
+		},
+		{
+			"section added",
+			map[string]string{"section": "b", "option": "k", "value": "v"},
+			[]string{"[a]", "k = v"},
+			[]string{"[a]", "k = v", "", "[b]", "k = v"},
+		},
+		{
+			"duplicates removed",
+			map[string]string{"section": "a", "option": "k", "value": "2"},
+			[]string{"[a]", "k = 1", "k = 3"},
+			[]string{"[a]", "k = 2"},
+		},
+		{
+			"unnamed section",
+			map[string]string{"option": "k", "value": "2"},
+			[]string{"k = 1", "[a]", "k = 3"},
+			[]string{"k = 2", "[a]", "k = 3"},
+		},
+		{
+			"absent",
+			map[string]string{"section": "a", "option": "k", "state": "absent"},
+			[]string{"[a]", "k = 1", "j = 2", "k = 3"},
+			[]string{"[a]", "j = 2"},
+		},
+		{
+			"commented out isn't the option",
+			map[string]string{"section": "a", "option": "k", "value": "1"},
+			[]string{"[a]", ";k = 0"},
+			[]string{"[a]", ";k = 0", "k = 1"},
+		},
+	}
+	for _, test := range tests {
+		test.params["dest"] = "/etc/x.ini"
+		i := &IniFile{}
+		if err := i.Configure(nil, test.params); err != nil {
+			t.Errorf("%s: configuring: %s", test.name, err)
+			continue
+		}
+		got, err := i.edit(test.lines)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestIniValue(t *testing.T) {
+	tests := []struct {
+		raw, want string
+	}{
+		{"v", "v"},
+		{"  v  ", "v"},
+		{`"v"`, "v"},
+		{`'v'`, "v"},
+		{`"v" ; comment`, "v"},
+		{"v ; comment", "v"},
+		{"v\t# comment", "v"},
+		{"a;b", "a;b"},
+		{"a#b", "a#b"},
+		{`"unterminated`, `"unterminated`},
+		{"", ""},
+	}
+	for _, test := range tests {
+		if got := iniValue(test.raw); got != test.want {
+			t.Errorf("iniValue(%q) = %q, want %q", test.raw, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package module
+
+import (
+	"fmt"
+	"github.com/pdbogen/gosible/transport"
+	"strings"
+)
+
+// initSystem is how Service drives one init system. The commands all take the name of the service.
+type initSystem struct {
+	name string
+	// running and enabled report whether the service is running, and whether it's started at boot.
+	running func(tr transport.Transport, svc string) (bool, error)
+	enabled func(tr transport.Transport, svc string) (bool, error)
+	// control returns the command that starts, stops, restarts or reloads the service.
+	control func(svc, action string) []string
+	enable  func(svc string) []string
+	disable func(svc string) []string
+	// needsReload, if set, reports whether the service's definition changed since the init system last read it; in
+	// which case daemonReload makes it read them again.
+	needsReload  func(tr transport.Transport, svc string) (bool, error)
+	daemonReload []string
+}
+
+// succeeds runs cmd and reports whether it exited zero. It's for commands that answer a question with their exit
+// status, so an exit status isn't an error; only failing to run cmd at all is.
+func succeeds(tr transport.Transport, what string, cmd ...string) (bool, error) {
+	_, stderr, res, err := tr.Do(cmd)
+	if err != nil {
+		return false, fmt.Errorf("%s: %s", what, err)
+	}
+	if res != 0 {
+		log.Debugf("stderr: %s", string(stderr))
+	}
+	return res == 0, nil
+}
+
+// sysvEnabledScript succeeds if $1 has a start link in any of the multi-user runlevels.
+const sysvEnabledScript = `for f in /etc/rc[2345].d/S*; do
+	case "${f##*/}" in S[0-9][0-9]"$1") exit 0;; esac
+done
+exit 1`
+
+// sysvEnableScript and sysvDisableScript use update-rc.d on Debian and its derivatives, and chkconfig elsewhere.
+// update-rc.d's defaults only adds links if there are none, so enable is needed to turn existing stop links around.
+const sysvEnableScript = `if command -v update-rc.d >/dev/null 2>&1; then
+	update-rc.d "$1" defaults && update-rc.d "$1" enable
+else
+	chkconfig --add "$1" && chkconfig "$1" on
+fi`
+
+const sysvDisableScript = `if command -v update-rc.d >/dev/null 2>&1; then
+	update-rc.d "$1" disable
+else
+	chkconfig "$1" off
+fi`
+
+// openrcEnabledScript succeeds if $1 is in the default runlevel; rc-update lists those as "name | default".
+const openrcEnabledScript = `rc-update show default | awk -v s="$1" '$1 == s { found = 1 } END { exit !found }'`
+
+// initSystems are keyed by the names accepted by Service's init parameter.
+var initSystems = map[string]*initSystem{
+	"systemd": {
+		name: "systemd",
+		running: func(tr transport.Transport, svc string) (bool, error) {
+			return succeeds(tr, "checking whether "+svc+" is running", "systemctl", "is-active", "--quiet", svc)
+		},
+		enabled: enabledSystemd,
+		control: func(svc, action string) []string { return []string{"systemctl", action, svc} },
+		enable:  func(svc string) []string { return []string{"systemctl", "enable", svc} },
+		disable: func(svc string) []string { return []string{"systemctl", "disable", svc} },
+		needsReload: func(tr transport.Transport, svc string) (bool, error) {
+			out, err := run(tr, "checking unit file of "+svc, "systemctl", "show", "-p", "NeedDaemonReload", svc)
+			if err != nil {
+				return false, err
+			}
+			return strings.TrimSpace(string(out)) == "NeedDaemonReload=yes", nil
+		},
+		daemonReload: []string{"systemctl", "daemon-reload"},
+	},
+	"openrc": {
+		name: "openrc",
+		running: func(tr transport.Transport, svc string) (bool, error) {
+			return succeeds(tr, "checking whether "+svc+" is running", "rc-service", svc, "status")
+		},
+		enabled: func(tr transport.Transport, svc string) (bool, error) {
+			return succeeds(tr, "checking whether "+svc+" is enabled", "sh", "-c", openrcEnabledScript, "sh", svc)
+		},
+		control: func(svc, action string) []string { return []string{"rc-service", svc, action} },
+		enable:  func(svc string) []string { return []string{"rc-update", "add", svc, "default"} },
+		disable: func(svc string) []string { return []string{"rc-update", "del", svc, "default"} },
+	},
+	"sysvinit": {
+		name: "sysvinit",
+		// LSB init scripts' status exits zero only if the service is running.
+		running: func(tr transport.Transport, svc string) (bool, error) {
+			return succeeds(tr, "checking whether "+svc+" is running", "/etc/init.d/"+svc, "status")
+		},
+		enabled: func(tr transport.Transport, svc string) (bool, error) {
+			return succeeds(tr, "checking whether "+svc+" is enabled", "sh", "-c", sysvEnabledScript, "sh", svc)
+		},
+		control: func(svc, action string) []string { return []string{"/etc/init.d/" + svc, action} },
+		enable:  func(svc string) []string { return []string{"sh", "-c", sysvEnableScript, "sh", svc} },
+		disable: func(svc string) []string { return []string{"sh", "-c", sysvDisableScript, "sh", svc} },
+	},
+}
+
+// enabledSystemd asks systemctl whether svc is enabled. Units that can't be enabled or disabled at all, like static
+// ones, count as enabled, since they're started whenever whatever needs them is.
+func enabledSystemd(tr transport.Transport, svc string) (bool, error) {
+	out, _, _, err := tr.Do([]string{"systemctl", "is-enabled", svc})
+	if err != nil {
+		return false, fmt.Errorf("checking whether %s is enabled: %s", svc, err)
+	}
+	switch state := strings.TrimSpace(string(out)); state {
+	case "enabled", "enabled-runtime", "alias", "static", "indirect", "generated":
+		return true, nil
+	case "disabled", "masked", "masked-runtime", "linked", "linked-runtime":
+		return false, nil
+	case "", "not-found":
+		return false, fmt.Errorf("no such service %s", svc)
+	default:
+		return false, fmt.Errorf("unexpected state of %s: %q", svc, state)
+	}
+}
+
+// detectInitScript prints the init system it finds. systemd is checked for the way sd_booted(3) does, since its
+// tools may be installed on systems it didn't boot.
+const detectInitScript = `if [ -d /run/systemd/system ]; then echo systemd
+elif command -v rc-service >/dev/null 2>&1; then echo openrc
+elif [ -d /etc/init.d ]; then echo sysvinit
+else exit 1
+fi`
+
+// detectInitSystem finds out which of initSystems the target uses.
+func detectInitSystem(tr transport.Transport) (string, error) {
+	out, stderr, res, err := tr.Do([]string{"sh", "-c", detectInitScript})
+	if err != nil {
+		return "", fmt.Errorf("detecting init system: %s", err)
+	}
+	if res != 0 {
+		log.Debugf("stderr: %s", string(stderr))
+		return "", fmt.Errorf("no supported init system found on target")
+	}
+	return strings.TrimSpace(string(out)), nil
+}
@@ -0,0 +1,103 @@
+package module
+
+import (
+	"errors"
+	"fmt"
+	"github.com/pdbogen/gosible/transport"
+	"github.com/pdbogen/gosible/types"
+	"regexp"
+)
+
+// LineInFile makes sure that a single line is present in, or absent from, a file on the target.
+type LineInFile struct {
+	editor
+	line   *string
+	regexp *regexp.Regexp
+	absent bool
+	where  insertion
+}
+
+func (l *LineInFile) Configure(_ *types.Target, params map[string]string) error {
+	*l = LineInFile{}
+	if err := l.editor.configure("lineinfile", params); err != nil {
+		return err
+	}
+
+	switch params["state"] {
+	case "", "present":
+	case "absent":
+		l.absent = true
+	default:
+		return fmt.Errorf("lineinfile: unknown state %s", params["state"])
+	}
+
+	if line, ok := params["line"]; ok {
+		l.line = &line
+	} else if !l.absent {
+		return errors.New("lineinfile configured without line")
+	}
+
+	if re, ok := params["regexp"]; ok {
+		compiled, err := regexp.Compile(re)
+		if err != nil {
+			return fmt.Errorf("parsing regexp %s: %s", re, err)
+		}
+		l.regexp = compiled
+	} else if l.line == nil {
+		return errors.New("lineinfile configured with neither line nor regexp")
+	}
+
+	where, err := parseInsertion(params)
+	if err != nil {
+		return fmt.Errorf("lineinfile: %s", err)
+	}
+	l.where = where
+	return nil
+}
+
+// matches reports whether line is one that LineInFile manages: one matching regexp, or else one equal to the line.
+func (l *LineInFile) matches(line string) bool {
+	if l.regexp != nil {
+		return l.regexp.MatchString(line)
+	}
+	return line == *l.line
+}
+
+// edit removes every managed line, for state absent. Otherwise, it replaces the last line matching regexp with the
+// line; or, if there's no such line, and the line isn't present already, it inserts it.
+func (l *LineInFile) edit(lines []string) ([]string, error) {
+	if l.absent {
+		var kept []string
+		for _, line := range lines {
+			if !l.matches(line) {
+				kept = append(kept, line)
+			}
+		}
+		return kept, nil
+	}
+
+	if l.regexp != nil {
+		for i := len(lines) - 1; i >= 0; i-- {
+			if l.regexp.MatchString(lines[i]) {
+				edited := append([]string{}, lines...)
+				edited[i] = *l.line
+				return edited, nil
+			}
+		}
+	}
+	for _, line := range lines {
+		if line == *l.line {
+			return lines, nil
+		}
+	}
+	return l.where.insert(lines, []string{*l.line}), nil
+}
+
+func (l *LineInFile) Execute(target *types.Target, tr transport.Transport) (bool, error) {
+	return l.apply(target, tr, l.edit)
+}
+
+func (*LineInFile) Name() string { return "lineinfile" }
+func (*LineInFile) Always() bool { return false }
+
+var _ Module = (*LineInFile)(nil)
@@ -0,0 +1,92 @@
+package module
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLineInFileEdit(t *testing.T) {
+	tests := []struct {
+		name   string
+		params map[string]string
+		lines  []string
+		want   []string
+	}{
+		{
+			"appended",
+			map[string]string{"line": "c"},
+			[]string{"a", "b"},
+			[]string{"a", "b", "c"},
+		},
+		{
+			"already present",
+			map[string]string{"line": "a"},
+			[]string{"a", "b"},
+			[]string{"a", "b"},
+		},
+		{
+			"empty file",
+			map[string]string{"line": "a"},
+			nil,
+			[]string{"a"},
+		},
+		{
+			"last match replaced",
+			map[string]string{"line": "port=2", "regexp": "^port="},
+			[]string{"port=0", "x", "port=1", "y"},
+			[]string{"port=0", "x", "port=2", "y"},
+		},
+		{
+			"no match inserted after",
+			map[string]string{"line": "port=2", "regexp": "^port=", "insertafter": "^x"},
+			[]string{"x", "y"},
+			[]string{"x", "port=2", "y"},
+		},
+		{
+			"inserted before",
+			map[string]string{"line": "new", "insertbefore": "^y"},
+			[]string{"x", "y", "y"},
+			[]string{"x", "new", "y", "y"},
+		},
+		{
+			"inserted at BOF",
+			map[string]string{"line": "#!/bin/sh", "insertbefore": "BOF"},
+			[]string{"echo"},
+			[]string{"#!/bin/sh", "echo"},
+		},
+		{
+			"insertafter not found goes at the end",
+			map[string]string{"line": "new", "insertafter": "^nothing"},
+			[]string{"x"},
+			[]string{"x", "new"},
+		},
+		{
+			"absent by line",
+			map[string]string{"line": "a", "state": "absent"},
+			[]string{"a", "b", "a"},
+			[]string{"b"},
+		},
+		{
+			"absent by regexp",
+			map[string]string{"regexp": "^#", "state": "absent"},
+			[]string{"#a", "b", "#c"},
+			[]string{"b"},
+		},
+	}
+	for _, test := range tests {
+		test.params["dest"] = "/etc/x"
+		l := &LineInFile{}
+		if err := l.Configure(nil, test.params); err != nil {
+			t.Errorf("%s: configuring: %s", test.name, err)
+			continue
+		}
+		got, err := l.edit(test.lines)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) && !(len(got) == 0 && len(test.want) == 0) {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
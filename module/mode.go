@@ -0,0 +1,132 @@
+package module
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// fileMode is a file mode as given in a task: either octal (e.g., 0640), or symbolic, like chmod(1)'s (e.g.,
+// u=rw,g=r,o= or go-w). A symbolic mode may depend on the mode a file already has, so it's applied to that mode,
+// rather than simply compared. Unlike chmod(1), a clause with no who, like +x, applies to user, group and other alike;
+// the target's umask isn't consulted.
+type fileMode struct {
+	spec    string
+	octal   *int64
+	clauses []modeClause
+}
+
+type modeClause struct {
+	who   int64 // the bits this clause may touch
+	op    byte  // '+', '-' or '='
+	perms string
+}
+
+const (
+	whoUser  = 04700
+	whoGroup = 02070
+	whoOther = 01007
+	whoAll   = whoUser | whoGroup | whoOther
+)
+
+func parseMode(spec string) (*fileMode, error) {
+	m := &fileMode{spec: spec}
+	if n, err := strconv.ParseInt(spec, 8, 16); err == nil {
+		if n < 0 || n > 07777 {
+			return nil, fmt.Errorf("mode %s out of range", spec)
+		}
+		m.octal = &n
+		return m, nil
+	}
+
+	for _, clause := range strings.Split(spec, ",") {
+		var who int64
+		i := 0
+	who:
+		for ; i < len(clause); i++ {
+			switch clause[i] {
+			case 'u':
+				who |= whoUser
+			case 'g':
+				who |= whoGroup
+			case 'o':
+				who |= whoOther
+			case 'a':
+				who |= whoAll
+			default:
+				break who
+			}
+		}
+		if who == 0 {
+			who = whoAll
+		}
+		if i == len(clause) {
+			return nil, fmt.Errorf("mode %s: clause %q has no operator", spec, clause)
+		}
+
+		// A clause may hold several operations, e.g. u+x-w.
+		for i < len(clause) {
+			op := clause[i]
+			if op != '+' && op != '-' && op != '=' {
+				return nil, fmt.Errorf("mode %s: unexpected %q in clause %q", spec, op, clause)
+			}
+			i++
+			start := i
+			for ; i < len(clause) && strings.IndexByte("rwxXst", clause[i]) >= 0; i++ {
+			}
+			m.clauses = append(m.clauses, modeClause{who: who, op: op, perms: clause[start:i]})
+		}
+	}
+	return m, nil
+}
+
+// apply returns the mode that results from applying m to a file that currently has mode prev. isDir matters for X,
+// which sets execute permission only on directories and on files that are already executable by someone.
+func (m *fileMode) apply(prev int64, isDir bool) int64 {
+	if m.octal != nil {
+		return *m.octal
+	}
+
+	mode := prev & 07777
+	for _, c := range m.clauses {
+		var bits int64
+		for _, p := range c.perms {
+			switch p {
+			case 'r':
+				bits |= 0444
+			case 'w':
+				bits |= 0222
+			case 'x':
+				bits |= 0111
+			case 'X':
+				if isDir || mode&0111 != 0 {
+					bits |= 0111
+				}
+			case 's':
+				bits |= 06000
+			case 't':
+				bits |= 01000
+			}
+		}
+		bits &= c.who
+
+		switch c.op {
+		case '+':
+			mode |= bits
+		case '-':
+			mode &^= bits
+		case '=':
+			mode = mode&^c.who | bits
+		}
+	}
+	return mode
+}
+
+func (m *fileMode) String() string {
+	return m.spec
+}
+
+// octalMode returns a fileMode that sets exactly mode.
+func octalMode(mode int64) *fileMode {
+	return &fileMode{spec: fmt.Sprintf("%04o", mode), octal: &mode}
+}
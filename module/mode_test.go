@@ -0,0 +1,49 @@
+package module
+
+import "testing"
+
+func TestParseModeApply(t *testing.T) {
+	tests := []struct {
+		spec  string
+		prev  int64
+		isDir bool
+		want  int64
+	}{
+		{"0640", 0755, false, 0640},
+		{"4755", 0644, false, 04755},
+		{"u=rw,g=r,o=", 0777, false, 0640},
+		{"go-w", 0666, false, 0644},
+		{"u+x", 0644, false, 0744},
+		{"+x", 0644, false, 0755},
+		{"a-x", 0755, false, 0644},
+		{"ug+rw", 0400, false, 0660},
+		{"u+x-w", 0644, false, 0544},
+		{"o=", 0777, false, 0770},
+		{"g=", 0640, false, 0600},
+		{"u+s", 0755, false, 04755},
+		{"g+s", 0755, true, 02755},
+		{"+t", 0777, true, 01777},
+		{"a+X", 0644, false, 0644},
+		{"a+X", 0744, false, 0755},
+		{"a+X", 0600, true, 0711},
+		{"go-rwx", 04755, false, 04700},
+	}
+	for _, test := range tests {
+		m, err := parseMode(test.spec)
+		if err != nil {
+			t.Errorf("parseMode(%q): %s", test.spec, err)
+			continue
+		}
+		if got := m.apply(test.prev, test.isDir); got != test.want {
+			t.Errorf("%q applied to %04o (dir: %t) = %04o, want %04o", test.spec, test.prev, test.isDir, got, test.want)
+		}
+	}
+}
+
+func TestParseModeErrors(t *testing.T) {
+	for _, spec := range []string{"", "10000", "u", "ug", "u+x,g", "u*x", "u+q", "z+x", "g=u"} {
+		if m, err := parseMode(spec); err == nil {
+			t.Errorf("parseMode(%q) = %+v, want an error", spec, m)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package module
+
+import (
+	"bytes"
+	"github.com/pdbogen/gosible/types"
+)
+
+// lineLogger is an io.Writer that logs each line written to it as soon as the line is complete, so that the output of
+// long-running commands can be followed as it happens. Lines are prefixed with the target and task.
+type lineLogger struct {
+	prefix string
+	buf    []byte
+}
+
+// setMetadata records value in the target's metadata under key, for later tasks to use.
+func setMetadata(target *types.Target, key, value string) {
+	if target.Metadata == nil {
+		target.Metadata = map[string]string{}
+	}
+	target.Metadata[key] = value
+}
+
+// registerResult records value in the target's metadata as <register>_<suffix>, if the task was annotated with
+// register.
+func registerResult(target *types.Target, register, suffix, value string) {
+	if register == "" {
+		return
+	}
+	setMetadata(target, register+"_"+suffix, value)
+}
+
+func newLineLogger(target *types.Target, stream string) *lineLogger {
+	task := "task"
+	if target.Metadata != nil && target.Metadata["task"] != "" {
+		task = target.Metadata["task"]
+	}
+	return &lineLogger{prefix: target.Name + "/" + task + ":" + stream}
+}
+
+func (l *lineLogger) Write(p []byte) (int, error) {
+	l.buf = append(l.buf, p...)
+	for {
+		i := bytes.IndexByte(l.buf, '\n')
+		if i < 0 {
+			break
+		}
+		log.Infof("%s: %s", l.prefix, string(l.buf[:i]))
+		l.buf = l.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// Flush logs any final, unterminated line.
+func (l *lineLogger) Flush() {
+	if len(l.buf) > 0 {
+		log.Infof("%s: %s", l.prefix, string(l.buf))
+		l.buf = nil
+	}
+}
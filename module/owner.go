@@ -0,0 +1,53 @@
+package module
+
+import (
+	"fmt"
+	"github.com/pdbogen/gosible/transport"
+	"strconv"
+	"strings"
+)
+
+// lookupUser resolves a user name to a UID on the target. A numeric name is returned as-is, without a lookup.
+func lookupUser(tr transport.Transport, name string) (int, error) {
+	if n, err := strconv.Atoi(name); err == nil {
+		return n, nil
+	}
+
+	out, stderr, res, err := tr.Do([]string{"id", "-u", name})
+	if err != nil {
+		return 0, fmt.Errorf("looking up user %s: %s", name, err)
+	}
+	if res != 0 {
+		return 0, fmt.Errorf("no user %s on target: %s", name, strings.TrimSpace(string(stderr)))
+	}
+	uid, err := strconv.Atoi(strings.TrimSpace(string(out)))
+	if err != nil {
+		return 0, fmt.Errorf("parsing UID of user %s: %s", name, err)
+	}
+	return uid, nil
+}
+
+// lookupGroup resolves a group name to a GID on the target. A numeric name is returned as-is, without a lookup.
+// getent is preferred, since it knows about NSS; but not every system has it. The fallback compares whole names, rather
+// than matching them as a pattern, so that a name like "a.b" can't match another group.
+func lookupGroup(tr transport.Transport, name string) (int, error) {
+	if n, err := strconv.Atoi(name); err == nil {
+		return n, nil
+	}
+
+	out, _, res, err := tr.Do([]string{
+		"sh", "-c", `getent group "$1" 2>/dev/null || awk -F: -v g="$1" '$1 == g' /etc/group`, "sh", name,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("looking up group %s: %s", name, err)
+	}
+	fields := strings.Split(strings.SplitN(string(out), "\n", 2)[0], ":")
+	if res != 0 || len(fields) < 3 {
+		return 0, fmt.Errorf("no group %s on target", name)
+	}
+	gid, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return 0, fmt.Errorf("parsing GID of group %s: %s", name, err)
+	}
+	return gid, nil
+}
@@ -1,82 +1,600 @@
 package module
 
 import (
-	"bytes"
 	"fmt"
 	"github.com/pdbogen/gosible/transport"
 	"github.com/pdbogen/gosible/types"
+	"os"
+	"path"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
+// The states Package can put packages into.
+const (
+	pkgPresent = "present"
+	pkgLatest  = "latest"
+	pkgAbsent  = "absent"
+	pkgPurged  = "purged"
+)
+
+// pkgSpec is a package as named in a task: a name, optionally pinned to a version as name=version.
+type pkgSpec struct {
+	name    string
+	version string
+	state   string
+}
+
+// Package installs, upgrades and removes packages with whichever package manager the target uses: the one named by
+// the manager parameter; or else the one recorded by Survey; or else the one Package finds itself.
 type Package struct {
-	adds    []string
-	removes []string
+	manager     string
+	pkgs        []pkgSpec
+	files       []string
+	hold        *bool
+	updateCache bool
+	cacheValid  time.Duration
+	register    string
+}
+
+func parsePkgs(list, state string) ([]pkgSpec, error) {
+	var specs []pkgSpec
+	for _, field := range strings.Fields(list) {
+		spec := pkgSpec{name: field, state: state}
+		if i := strings.Index(field, "="); i >= 0 {
+			spec.name, spec.version = field[:i], field[i+1:]
+			if spec.name == "" || spec.version == "" {
+				return nil, fmt.Errorf("bad package %q; expected name or name=version", field)
+			}
+			if state != pkgPresent {
+				return nil, fmt.Errorf("package %s: versions can only be given for state present", spec.name)
+			}
+		}
+		specs = append(specs, spec)
+	}
+	return specs, nil
 }
 
-func (p *Package) Configure(_ *types.Target, params map[string]string) error {
+func (p *Package) Configure(target *types.Target, params map[string]string) error {
 	*p = Package{}
 
-	if install, ok := params["install"]; ok {
-		p.adds = strings.Split(install, " ")
+	if manager, ok := params["manager"]; ok {
+		if _, ok := packageManagers[manager]; !ok {
+			return fmt.Errorf("unsupported package manager %s", manager)
+		}
+		p.manager = manager
 	}
 
-	if remove, ok := params["remove"]; ok {
-		p.removes = strings.Split(remove, " ")
+	// name and state are the general form; install and remove are shorthand for states present and absent.
+	state := pkgPresent
+	if s, ok := params["state"]; ok {
+		switch s {
+		case pkgPresent, pkgLatest, pkgAbsent, pkgPurged:
+			state = s
+		default:
+			return fmt.Errorf("unknown package state %s", s)
+		}
+	}
+	for _, list := range []struct{ param, state string }{
+		{"name", state},
+		{"install", pkgPresent},
+		{"remove", pkgAbsent},
+	} {
+		specs, err := parsePkgs(params[list.param], list.state)
+		if err != nil {
+			return err
+		}
+		p.pkgs = append(p.pkgs, specs...)
+	}
+
+	// Package files are relative to the payload, like sync's source. They're staged on the target under their own
+	// names, so those must differ.
+	staged := map[string]string{}
+	for _, file := range strings.Fields(params["file"]) {
+		if file[0] != '/' {
+			file = strings.TrimRight(target.Metadata["rootpath"], "/") + "/" + file
+		}
+		if stat, err := os.Stat(file); err != nil {
+			return fmt.Errorf("package file %s: %s", file, err)
+		} else if !stat.Mode().IsRegular() {
+			return fmt.Errorf("package file %s is not a regular file", file)
+		}
+		if prev, ok := staged[path.Base(file)]; ok {
+			return fmt.Errorf("package files %s and %s have the same name", prev, file)
+		}
+		staged[path.Base(file)] = file
+		p.files = append(p.files, file)
 	}
 
-	if p.adds != nil && p.removes != nil {
-		pkgs := map[string]bool{}
-		for _, p := range p.adds {
-			pkgs[p] = true
+	pkgs := map[string]string{}
+	for _, spec := range p.pkgs {
+		if prev, ok := pkgs[spec.name]; ok && prev != spec.state {
+			return fmt.Errorf("cannot both make package %s %s and %s", spec.name, prev, spec.state)
 		}
-		for _, p := range p.removes {
-			if _, ok := pkgs[p]; ok {
-				return fmt.Errorf("cannot both add and remove package %s", p)
+		pkgs[spec.name] = spec.state
+	}
+
+	if hold, ok := params["hold"]; ok {
+		h, err := strconv.ParseBool(hold)
+		if err != nil {
+			return fmt.Errorf("parsing hold %s: %s", hold, err)
+		}
+		p.hold = &h
+	}
+	if p.hold != nil && *p.hold {
+		for _, spec := range p.pkgs {
+			if spec.state == pkgAbsent || spec.state == pkgPurged {
+				return fmt.Errorf("cannot hold package %s, which is to be %s", spec.name, spec.state)
 			}
 		}
 	}
 
+	if update, ok := params["update_cache"]; ok {
+		u, err := strconv.ParseBool(update)
+		if err != nil {
+			return fmt.Errorf("parsing update_cache %s: %s", update, err)
+		}
+		p.updateCache = u
+	}
+	// cache_valid_time is in seconds, as it is for ansible; but a duration like 1h is more readable.
+	if valid, ok := params["cache_valid_time"]; ok {
+		if secs, err := strconv.Atoi(valid); err == nil {
+			p.cacheValid = time.Duration(secs) * time.Second
+		} else if d, err := time.ParseDuration(valid); err == nil {
+			p.cacheValid = d
+		} else {
+			return fmt.Errorf("parsing cache_valid_time %s: not a number of seconds or a duration", valid)
+		}
+	}
+
+	p.register = params["register"]
+	return nil
+}
+
+// targetPackageManager picks the package manager to use: the one named, if any; or else the one in the target's
+// metadata, which is recorded there if it had to be detected, so that later tasks needn't detect it again.
+func targetPackageManager(target *types.Target, tr transport.Transport, name string) (*packageManager, error) {
+	if name == "" && target.Metadata != nil {
+		name = target.Metadata["pkg_manager"]
+	}
+	if name == "" {
+		detected, err := detectPackageManager(tr)
+		if err != nil {
+			return nil, err
+		}
+		setMetadata(target, "pkg_manager", detected)
+		name = detected
+	}
+
+	pm, ok := packageManagers[name]
+	if !ok {
+		return nil, fmt.Errorf("unsupported package manager %s", name)
+	}
+	return pm, nil
+}
+
+// refreshIfStale refreshes the package index, if update_cache is set; unless it's been refreshed within
+// cache_valid_time, by gosible or otherwise. It reports whether it refreshed the index.
+func (p *Package) refreshIfStale(target *types.Target, tr transport.Transport, pm *packageManager) (bool, error) {
+	if !p.updateCache {
+		return false, nil
+	}
+	if pm.refresh == nil {
+		return false, fmt.Errorf("%s cannot refresh its package index without upgrading the whole system, so "+
+			"update_cache isn't supported with it", pm.name)
+	}
+	if p.cacheValid > 0 {
+		age, err := pm.cacheAge(tr)
+		if err != nil {
+			return false, err
+		}
+		if age >= 0 && age < p.cacheValid {
+			log.Debugf("%s: package index is %s old, so it's still valid", target.Name, age)
+			return false, nil
+		}
+	}
+
+	if err := refreshCache(target, tr, pm); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// refreshCache refreshes the package index, and records when it did.
+func refreshCache(target *types.Target, tr transport.Transport, pm *packageManager) error {
+	if err := stream(target, tr, "refreshing package index", pm.refresh); err != nil {
+		return err
+	}
+	if _, err := run(tr, "recording package index refresh", "sh", "-c", touchStampScript, "sh", pm.cacheStamp); err != nil {
+		return err
+	}
+	log.Infof("%s: refreshed package index", target.Name)
 	return nil
 }
 
+// packageStageDir is where package files are staged on the target. They're left there, so that a file that hasn't
+// changed since the last run needn't be uploaded again.
+const packageStageDir = "/var/cache/gosible/packages"
+
+// stagedFile is a package file uploaded to the target, with the name and version of the package in it.
+type stagedFile struct {
+	path    string
+	name    string
+	version string
+}
+
+// stageFiles uploads the package files to packageStageDir on the target, unless the copies there are already the
+// same, and reads what's in them.
+func (p *Package) stageFiles(target *types.Target, tr transport.Transport, pm *packageManager) ([]stagedFile, error) {
+	if pm.inspect == nil {
+		return nil, fmt.Errorf("%s cannot install package files", pm.name)
+	}
+	if _, err := run(tr, "creating "+packageStageDir, "mkdir", "-p", "-m", "0700", packageStageDir); err != nil {
+		return nil, err
+	}
+
+	staged := make([]stagedFile, len(p.files))
+	for i, file := range p.files {
+		// The name itself is kept, since apt goes by its extension.
+		local := file
+		remote := packageStageDir + "/" + path.Base(file)
+		f := &File{state: stateFile, source: &local, dest: remote, mode: octalMode(0644)}
+		if _, err := f.Execute(target, tr); err != nil {
+			return nil, fmt.Errorf("uploading %s: %s", file, err)
+		}
+		name, version, err := pm.inspect(tr, remote)
+		if err != nil {
+			return nil, err
+		}
+		staged[i] = stagedFile{path: remote, name: name, version: version}
+	}
+	return staged, nil
+}
+
+// stream runs cmd, logging its output as it arrives.
+func stream(target *types.Target, tr transport.Transport, what string, cmd []string) error {
+	outLog := newLineLogger(target, "out")
+	errLog := newLineLogger(target, "err")
+	res, err := tr.DoStream(cmd, strings.NewReader(""), outLog, errLog)
+	outLog.Flush()
+	errLog.Flush()
+	if err != nil {
+		return fmt.Errorf("%s: %s", what, err)
+	}
+	if res != 0 {
+		return fmt.Errorf("non-zero %s: %d", what, res)
+	}
+	return nil
+}
+
+// versionMatches reports whether an installed version satisfies a pinned one. rpm-based package managers report
+// version-release, but a pin may leave the release off.
+func versionMatches(installed, pinned string) bool {
+	return installed == pinned || strings.HasPrefix(installed, pinned+"-")
+}
+
+// plan works out which packages need which command, given what's installed now: packages that are already as wanted
+// are left out, so that nothing is run at all if there's nothing to do. Packages wanted at their latest version are
+// the exception, since only the package manager knows whether there's a newer one; unless they're held, in which case
+// they're left at the version they have.
+func (p *Package) plan(tr transport.Transport, pm *packageManager, before map[string]string) (installs, upgrades, removes, purges []string, err error) {
+	var residual map[string]bool
+	for _, spec := range p.pkgs {
+		version, installed := before[spec.name]
+		switch spec.state {
+		case pkgPresent:
+			if spec.version != "" {
+				if pm.pin == nil {
+					return nil, nil, nil, nil, fmt.Errorf("%s cannot install specific versions", pm.name)
+				}
+				if !installed || !versionMatches(version, spec.version) {
+					installs = append(installs, pm.pin(spec.name, spec.version))
+				}
+			} else if !installed {
+				installs = append(installs, spec.name)
+			}
+		case pkgLatest:
+			if installed {
+				upgrades = append(upgrades, spec.name)
+			} else {
+				installs = append(installs, spec.name)
+			}
+		case pkgAbsent:
+			if installed {
+				removes = append(removes, spec.name)
+			}
+		case pkgPurged:
+			if residual == nil && pm.residual != nil {
+				residual = map[string]bool{}
+				names, err := pm.residual(tr, p.names())
+				if err != nil {
+					return nil, nil, nil, nil, err
+				}
+				for _, name := range names {
+					residual[name] = true
+				}
+			}
+			if installed || residual[spec.name] {
+				purges = append(purges, spec.name)
+			}
+		}
+	}
+
+	if len(upgrades) > 0 && pm.held != nil {
+		held, err := pm.held(tr, upgrades)
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+		var unheld []string
+		for _, name := range upgrades {
+			if held[name] {
+				log.Infof("package %s is held, so it won't be upgraded", name)
+				continue
+			}
+			unheld = append(unheld, name)
+		}
+		upgrades = unheld
+	}
+	return installs, upgrades, removes, purges, nil
+}
+
+func (p *Package) names() []string {
+	names := make([]string, len(p.pkgs))
+	for i, spec := range p.pkgs {
+		names[i] = spec.name
+	}
+	return names
+}
+
+// setHolds holds or releases the packages, as configured, and returns the ones whose hold changed.
+func (p *Package) setHolds(target *types.Target, tr transport.Transport, pm *packageManager) ([]string, error) {
+	if p.hold == nil {
+		return nil, nil
+	}
+	if pm.held == nil {
+		return nil, fmt.Errorf("%s cannot hold packages", pm.name)
+	}
+
+	held, err := pm.held(tr, p.names())
+	if err != nil {
+		return nil, err
+	}
+	var change []string
+	for _, name := range p.names() {
+		if held[name] != *p.hold {
+			change = append(change, name)
+		}
+	}
+	if change == nil {
+		return nil, nil
+	}
+
+	cmd, what := pm.unhold, "releasing packages"
+	if *p.hold {
+		cmd, what = pm.hold, "holding packages"
+	}
+	if err := stream(target, tr, what, append(append([]string{}, cmd...), change...)); err != nil {
+		return nil, err
+	}
+	return change, nil
+}
+
+// Execute brings the packages to their configured states. Each package's version is queried before and after, so that
+// exactly the packages that were installed, upgraded, downgraded or removed are reported; if the task is annotated
+// with register, these are also stored in the target's metadata as <register>_changed, one per line. Refreshing the
+// package index counts as a change, too.
 func (p *Package) Execute(target *types.Target, tr transport.Transport) (bool, error) {
-	pkgPrev, _, _, err := tr.Do([]string{"sha256sum", "/var/lib/dpkg/status"})
+	pm, err := targetPackageManager(target, tr, p.manager)
+	if err != nil {
+		return false, err
+	}
+
+	refreshed, err := p.refreshIfStale(target, tr, pm)
 	if err != nil {
-		return false, fmt.Errorf("error retrieving pre package status: %s", err)
+		return false, err
 	}
-	cmd := []string{
-		"apt-get", "-y", "install",
+	names := p.names()
+	if len(names) == 0 && len(p.files) == 0 {
+		return refreshed, nil
 	}
-	if p.adds != nil {
-		cmd = append(cmd, p.adds...)
+
+	var staged []stagedFile
+	if len(p.files) > 0 {
+		files, err := p.stageFiles(target, tr, pm)
+		if err != nil {
+			return false, err
+		}
+		staged = files
+		for _, sf := range staged {
+			names = append(names, sf.name)
+		}
 	}
-	if p.removes != nil {
-		for _, p := range p.removes {
-			cmd = append(cmd, p+"-")
+
+	before, err := pm.query(tr, names)
+	if err != nil {
+		return false, err
+	}
+
+	// A held package won't be upgraded, so release holds first, and make new ones last.
+	var report []string
+	if p.hold != nil && !*p.hold {
+		released, err := p.setHolds(target, tr, pm)
+		if err != nil {
+			return false, err
+		}
+		for _, name := range released {
+			report = append(report, name+": released")
 		}
 	}
 
-	stdout, _, res, err := tr.Do(cmd)
+	installs, upgrades, removes, purges, err := p.plan(tr, pm, before)
 	if err != nil {
-		return false, fmt.Errorf("executing package changes: %s", err)
+		return false, err
 	}
-	if res != 0 {
-		return false, fmt.Errorf("non-zero executing package changes: %d", res)
+	// A package file is installed unless exactly its version is installed already.
+	var fileInstalls []string
+	for _, sf := range staged {
+		if before[sf.name] == sf.version {
+			log.Debugf("%s: package %s %s is already installed", target.Name, sf.name, sf.version)
+			continue
+		}
+		fileInstalls = append(fileInstalls, sf.path)
+	}
+
+	for _, step := range []struct {
+		what string
+		cmd  []string
+		pkgs []string
+	}{
+		{"installing packages", pm.install, installs},
+		{"installing package files", pm.install, fileInstalls},
+		{"upgrading packages", pm.upgrade, upgrades},
+		{"removing packages", pm.remove, removes},
+		{"purging packages", pm.purge, purges},
+	} {
+		if len(step.pkgs) == 0 {
+			continue
+		}
+		if err := stream(target, tr, step.what, append(append([]string{}, step.cmd...), step.pkgs...)); err != nil {
+			return false, err
+		}
 	}
 
-	for _, l := range strings.Split(string(stdout), "\n") {
-		log.Debugf("package:out: %s", l)
+	if installs != nil || fileInstalls != nil || upgrades != nil || removes != nil || purges != nil {
+		after, err := pm.query(tr, names)
+		if err != nil {
+			return false, err
+		}
+		report = append(report, versionChanges(names, before, after, purges)...)
+	}
+
+	if p.hold != nil && *p.hold {
+		held, err := p.setHolds(target, tr, pm)
+		if err != nil {
+			return false, err
+		}
+		for _, name := range held {
+			report = append(report, name+": held")
+		}
 	}
 
-	pkgPost, _, _, err := tr.Do([]string{"sha256sum", "/var/lib/dpkg/status"})
+	for _, line := range report {
+		log.Infof("%s: package %s", target.Name, line)
+	}
+	registerResult(target, p.register, "changed", strings.Join(report, "\n"))
+	return refreshed || len(report) > 0, nil
+}
+
+// versionChanges describes how each package's version changed between before and after. Purged packages that weren't
+// installed had only their configuration left, so they're reported as purged rather than removed.
+func versionChanges(names []string, before, after map[string]string, purges []string) []string {
+	purged := map[string]bool{}
+	for _, name := range purges {
+		purged[name] = true
+	}
+
+	var report []string
+	seen := map[string]bool{}
+	sorted := append([]string{}, names...)
+	sort.Strings(sorted)
+	for _, name := range sorted {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		prev, wasInstalled := before[name]
+		cur, isInstalled := after[name]
+		switch {
+		case !wasInstalled && isInstalled:
+			report = append(report, fmt.Sprintf("%s: installed %s", name, cur))
+		case wasInstalled && !isInstalled:
+			report = append(report, fmt.Sprintf("%s: removed %s", name, prev))
+		case !wasInstalled && purged[name]:
+			report = append(report, fmt.Sprintf("%s: purged", name))
+		case compareVersions(prev, cur) < 0:
+			report = append(report, fmt.Sprintf("%s: upgraded %s -> %s", name, prev, cur))
+		case prev != cur:
+			report = append(report, fmt.Sprintf("%s: downgraded %s -> %s", name, prev, cur))
+		}
+	}
+	return report
+}
+
+// compareVersions compares two package versions, roughly as dpkg and rpm do: the epochs first, then the rest, in which
+// runs of digits are compared as numbers, and anything else as text, where a tilde sorts before anything, even the end
+// of the version. It returns -1, 0 or 1.
+func compareVersions(a, b string) int {
+	ea, a := versionEpoch(a)
+	eb, b := versionEpoch(b)
+	if ea != eb {
+		if ea < eb {
+			return -1
+		}
+		return 1
+	}
+
+	for a != "" || b != "" {
+		if strings.HasPrefix(a, "~") || strings.HasPrefix(b, "~") {
+			if !strings.HasPrefix(a, "~") {
+				return 1
+			}
+			if !strings.HasPrefix(b, "~") {
+				return -1
+			}
+			a, b = a[1:], b[1:]
+			continue
+		}
+
+		var sa, sb string
+		sa, a = versionSegment(a)
+		sb, b = versionSegment(b)
+		na, errA := strconv.ParseUint(sa, 10, 64)
+		nb, errB := strconv.ParseUint(sb, 10, 64)
+		switch {
+		case errA == nil && errB == nil:
+			if na != nb {
+				if na < nb {
+					return -1
+				}
+				return 1
+			}
+		case sa != sb:
+			if sa < sb {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// versionEpoch splits the epoch, as in the 1 of 1:2.0, off of v. A version without one has an epoch of 0.
+func versionEpoch(v string) (uint64, string) {
+	i := strings.IndexByte(v, ':')
+	if i < 0 {
+		return 0, v
+	}
+	epoch, err := strconv.ParseUint(v[:i], 10, 64)
 	if err != nil {
-		return false, fmt.Errorf("error retrieving post package status: %s", err)
+		return 0, v
 	}
+	return epoch, v[i+1:]
+}
 
-	if pkgPrev == nil || (pkgPost != nil && !bytes.Equal(pkgPrev, pkgPost)) {
-		return true, nil
+// versionSegment splits off the leading run of digits, or of non-digits, from v.
+func versionSegment(v string) (string, string) {
+	if v == "" {
+		return "", ""
+	}
+	digit := v[0] >= '0' && v[0] <= '9'
+	i := 1
+	for i < len(v) && v[i] != '~' && (v[i] >= '0' && v[i] <= '9') == digit {
+		i++
 	}
-	return false, nil
+	return v[:i], v[i:]
 }
 
 func (*Package) Name() string { return "package" }
@@ -0,0 +1,56 @@
+package module
+
+import "testing"
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.0", "1.0", 0},
+		{"1.0", "1.1", -1},
+		{"1.10", "1.9", 1},
+		{"1.0.1", "1.0", 1},
+		{"2.0", "10.0", -1},
+		{"1.0-1", "1.0-2", -1},
+		{"1.2.3-1ubuntu1", "1.2.3-1", 1},
+		{"1.0~rc1", "1.0", -1},
+		{"1.0~rc1", "1.0~rc2", -1},
+		{"1.0~~", "1.0~", -1},
+		{"1.0a", "1.0b", -1},
+		{"1:2.0", "1:2.0", 0},
+		{"1:2.0", "2.5", 1},
+		{"1:2.0", "2:1.0", -1},
+		{"0:2.0", "2.0", 0},
+		{"1:2.0", "1:2.5", -1},
+		{"007", "7", 0},
+		{"", "1", -1},
+		{"", "", 0},
+	}
+	for _, test := range tests {
+		if got := compareVersions(test.a, test.b); got != test.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", test.a, test.b, got, test.want)
+		}
+		if got := compareVersions(test.b, test.a); got != -test.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", test.b, test.a, got, -test.want)
+		}
+	}
+}
+
+func TestVersionMatches(t *testing.T) {
+	tests := []struct {
+		installed, pinned string
+		want              bool
+	}{
+		{"1.2.3", "1.2.3", true},
+		{"1.2.3-4.el9", "1.2.3", true},
+		{"1.2.3-4.el9", "1.2.3-4.el9", true},
+		{"1.2.30", "1.2.3", false},
+		{"1.2.3", "1.2.3-4", false},
+	}
+	for _, test := range tests {
+		if got := versionMatches(test.installed, test.pinned); got != test.want {
+			t.Errorf("versionMatches(%q, %q) = %t, want %t", test.installed, test.pinned, got, test.want)
+		}
+	}
+}
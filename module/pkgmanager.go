@@ -0,0 +1,365 @@
+package module
+
+import (
+	"fmt"
+	"github.com/pdbogen/gosible/transport"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// packageManager is how Package drives one distribution's package manager. Each command has the packages appended to
+// it.
+type packageManager struct {
+	name    string
+	install []string
+	// upgrade brings installed packages up to the latest available version.
+	upgrade []string
+	remove  []string
+	// purge removes packages along with their configuration.
+	purge []string
+	// query returns the installed version of each of pkgs that's installed at all.
+	query func(tr transport.Transport, pkgs []string) (map[string]string, error)
+	// residual, if set, returns those of pkgs that aren't installed, but whose configuration is still present.
+	residual func(tr transport.Transport, pkgs []string) ([]string, error)
+	// pin formats a package name and version for install; nil if versions can't be asked for. Installing a pinned
+	// version may change a held package, since the version was asked for explicitly.
+	pin func(name, version string) string
+	// hold and unhold stop and allow changes to the installed version; held returns those of pkgs that are held. They
+	// are all nil if the package manager has no such thing.
+	hold   []string
+	unhold []string
+	held   func(tr transport.Transport, pkgs []string) (map[string]bool, error)
+	// refresh updates the package index, and cacheStamp is a path whose modification time says when it was last
+	// updated. Not every package manager keeps such a path up to date itself, so it's also touched after refresh.
+	// refresh is nil if the index can't safely be refreshed on its own.
+	refresh    []string
+	cacheStamp string
+	// inspect returns the name and version of the package in a package file on the target, which install accepts in
+	// place of a package name; nil if it can't install package files.
+	inspect func(tr transport.Transport, path string) (name, version string, err error)
+}
+
+// aptGet returns an apt-get command that won't stop to ask questions.
+func aptGet(args ...string) []string {
+	return append([]string{"env", "DEBIAN_FRONTEND=noninteractive", "apt-get", "-y"}, args...)
+}
+
+func pinEquals(name, version string) string { return name + "=" + version }
+func pinHyphen(name, version string) string { return name + "-" + version }
+
+// packageManagers are keyed by the names accepted by Package's manager parameter.
+var packageManagers = map[string]*packageManager{
+	"apt": {
+		name:       "apt",
+		install:    aptGet("--allow-downgrades", "--allow-change-held-packages", "install"),
+		upgrade:    aptGet("--only-upgrade", "install"),
+		remove:     aptGet("remove"),
+		purge:      aptGet("purge"),
+		query:      queryDpkg,
+		residual:   residualDpkg,
+		pin:        pinEquals,
+		hold:       []string{"apt-mark", "hold"},
+		unhold:     []string{"apt-mark", "unhold"},
+		held:       heldApt,
+		refresh:    aptGet("update"),
+		cacheStamp: "/var/lib/apt/periodic/update-success-stamp",
+		inspect:    inspectDeb,
+	},
+	"dnf": {
+		name:       "dnf",
+		install:    []string{"dnf", "-y", "install"},
+		upgrade:    []string{"dnf", "-y", "upgrade"},
+		remove:     []string{"dnf", "-y", "remove"},
+		purge:      []string{"dnf", "-y", "remove"},
+		query:      queryRpm,
+		pin:        pinHyphen,
+		hold:       []string{"dnf", "versionlock", "add"},
+		unhold:     []string{"dnf", "versionlock", "delete"},
+		held:       heldVersionlock("dnf"),
+		refresh:    []string{"dnf", "-y", "makecache"},
+		cacheStamp: "/var/cache/dnf/last_makecache",
+		inspect:    inspectRpm,
+	},
+	"yum": {
+		name:       "yum",
+		install:    []string{"yum", "-y", "install"},
+		upgrade:    []string{"yum", "-y", "update"},
+		remove:     []string{"yum", "-y", "remove"},
+		purge:      []string{"yum", "-y", "remove"},
+		query:      queryRpm,
+		pin:        pinHyphen,
+		hold:       []string{"yum", "versionlock", "add"},
+		unhold:     []string{"yum", "versionlock", "delete"},
+		held:       heldVersionlock("yum"),
+		refresh:    []string{"yum", "-y", "makecache"},
+		cacheStamp: "/var/cache/yum/last_makecache",
+		inspect:    inspectRpm,
+	},
+	"zypper": {
+		name:       "zypper",
+		install:    []string{"zypper", "-n", "install", "--oldpackage"},
+		upgrade:    []string{"zypper", "-n", "update"},
+		remove:     []string{"zypper", "-n", "remove"},
+		purge:      []string{"zypper", "-n", "remove"},
+		query:      queryRpm,
+		pin:        pinEquals,
+		hold:       []string{"zypper", "-n", "addlock"},
+		unhold:     []string{"zypper", "-n", "removelock"},
+		held:       heldZypper,
+		refresh:    []string{"zypper", "-n", "refresh"},
+		cacheStamp: "/var/cache/zypp/raw",
+		inspect:    inspectRpm,
+	},
+	// Arch doesn't support partial upgrades: installing from a refreshed index onto an outdated system can break it. So
+	// pacman has no refresh, as the only safe one, -Syu, would upgrade the whole system.
+	"pacman": {
+		name:    "pacman",
+		install: []string{"pacman", "-S", "--noconfirm", "--needed"},
+		upgrade: []string{"pacman", "-S", "--noconfirm", "--needed"},
+		remove:  []string{"pacman", "-R", "--noconfirm"},
+		purge:   []string{"pacman", "-Rn", "--noconfirm"},
+		query:   queryPacman,
+	},
+	"apk": {
+		name:       "apk",
+		install:    []string{"apk", "add"},
+		upgrade:    []string{"apk", "add", "--upgrade"},
+		remove:     []string{"apk", "del"},
+		purge:      []string{"apk", "del", "--purge"},
+		query:      queryApk,
+		pin:        pinEquals,
+		refresh:    []string{"apk", "update"},
+		cacheStamp: "/var/cache/apk",
+	},
+}
+
+// detectScript prints the first package manager command it finds. dnf comes ahead of yum, since where both exist, yum
+// is usually just an alias for dnf.
+const detectScript = `for m in apt-get dnf yum zypper pacman apk; do
+	if command -v $m >/dev/null 2>&1; then echo $m; exit 0; fi
+done
+exit 1`
+
+// detectPackageManager finds out which of packageManagers the target uses.
+func detectPackageManager(tr transport.Transport) (string, error) {
+	out, stderr, res, err := tr.Do([]string{"sh", "-c", detectScript})
+	if err != nil {
+		return "", fmt.Errorf("detecting package manager: %s", err)
+	}
+	if res != 0 {
+		log.Debugf("stderr: %s", string(stderr))
+		return "", fmt.Errorf("no supported package manager found on target")
+	}
+	name := strings.TrimSpace(string(out))
+	if name == "apt-get" {
+		name = "apt"
+	}
+	return name, nil
+}
+
+// queryDpkg asks dpkg about pkgs. dpkg-query exits non-zero if any of them are unknown, but still describes the rest.
+func queryDpkg(tr transport.Transport, pkgs []string) (map[string]string, error) {
+	cmd := append([]string{"dpkg-query", "-W", "-f", "${Package}\\t${db:Status-Abbrev}\\t${Version}\\n"}, pkgs...)
+	out, _, _, err := tr.Do(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("querying installed packages: %s", err)
+	}
+	versions := map[string]string{}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Split(line, "\t")
+		// The status abbreviation's second letter is the current state; 'i' is installed.
+		if len(fields) != 3 || len(fields[1]) < 2 || fields[1][1] != 'i' {
+			continue
+		}
+		versions[fields[0]] = fields[2]
+	}
+	return versions, nil
+}
+
+// queryRpm asks rpm about pkgs. Like dpkg-query, rpm exits non-zero if any of them aren't installed.
+func queryRpm(tr transport.Transport, pkgs []string) (map[string]string, error) {
+	cmd := append([]string{"rpm", "-q", "--qf", "%{NAME}\\t%{VERSION}-%{RELEASE}\\n"}, pkgs...)
+	out, _, _, err := tr.Do(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("querying installed packages: %s", err)
+	}
+	return tabbedVersions(string(out), "\t"), nil
+}
+
+// queryPacman asks pacman about pkgs; it, too, exits non-zero if any of them aren't installed.
+func queryPacman(tr transport.Transport, pkgs []string) (map[string]string, error) {
+	out, _, _, err := tr.Do(append([]string{"pacman", "-Q"}, pkgs...))
+	if err != nil {
+		return nil, fmt.Errorf("querying installed packages: %s", err)
+	}
+	return tabbedVersions(string(out), " "), nil
+}
+
+// queryApk lists every installed package, as name-version, and picks out pkgs. apk has no way to ask after specific
+// packages that also gives their versions.
+func queryApk(tr transport.Transport, pkgs []string) (map[string]string, error) {
+	out, err := run(tr, "querying installed packages", "apk", "info", "-v")
+	if err != nil {
+		return nil, err
+	}
+	wanted := map[string]bool{}
+	for _, pkg := range pkgs {
+		wanted[pkg] = true
+	}
+	versions := map[string]string{}
+	for _, line := range strings.Split(string(out), "\n") {
+		// Versions end in a release, e.g. py3-six-1.16.0-r3; so the version starts after the hyphen before that.
+		r := strings.LastIndex(line, "-r")
+		if r < 0 {
+			continue
+		}
+		v := strings.LastIndex(line[:r], "-")
+		if v < 0 {
+			continue
+		}
+		if name := line[:v]; wanted[name] {
+			versions[name] = line[v+1:]
+		}
+	}
+	return versions, nil
+}
+
+// tabbedVersions parses lines of "name<sep>version".
+func tabbedVersions(out, sep string) map[string]string {
+	versions := map[string]string{}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.SplitN(line, sep, 2)
+		if len(fields) != 2 {
+			continue
+		}
+		versions[fields[0]] = strings.TrimSpace(fields[1])
+	}
+	return versions
+}
+
+// residualDpkg finds packages in dpkg's config-files state: removed, but not purged.
+func residualDpkg(tr transport.Transport, pkgs []string) ([]string, error) {
+	cmd := append([]string{"dpkg-query", "-W", "-f", "${Package}\\t${db:Status-Abbrev}\\n"}, pkgs...)
+	out, _, _, err := tr.Do(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("querying removed packages: %s", err)
+	}
+	var residual []string
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) == 2 && len(fields[1]) >= 2 && fields[1][1] == 'c' {
+			residual = append(residual, fields[0])
+		}
+	}
+	return residual, nil
+}
+
+// heldApt lists packages marked as held by apt-mark.
+func heldApt(tr transport.Transport, pkgs []string) (map[string]bool, error) {
+	out, err := run(tr, "listing held packages", append([]string{"apt-mark", "showhold"}, pkgs...)...)
+	if err != nil {
+		return nil, err
+	}
+	held := map[string]bool{}
+	for _, name := range strings.Fields(string(out)) {
+		held[name] = true
+	}
+	return held, nil
+}
+
+// heldVersionlock lists packages locked by the versionlock plugin of dnf or yum, which lists them as name-version
+// patterns, e.g. nginx-1:1.24.0-1.el9.*; optionally with an epoch in front.
+func heldVersionlock(command string) func(transport.Transport, []string) (map[string]bool, error) {
+	return func(tr transport.Transport, pkgs []string) (map[string]bool, error) {
+		out, err := run(tr, "listing locked packages", command, "-q", "versionlock", "list")
+		if err != nil {
+			return nil, err
+		}
+		held := map[string]bool{}
+		for _, line := range strings.Fields(string(out)) {
+			if i := strings.Index(line, ":"); i >= 0 && strings.IndexAny(line[:i], "-.") < 0 {
+				line = line[i+1:]
+			}
+			for _, pkg := range pkgs {
+				rest := strings.TrimPrefix(line, pkg+"-")
+				if rest != line && rest != "" && rest[0] >= '0' && rest[0] <= '9' {
+					held[pkg] = true
+				}
+			}
+		}
+		return held, nil
+	}
+}
+
+// heldZypper lists packages locked by zypper, from the Name column of its table of locks.
+func heldZypper(tr transport.Transport, pkgs []string) (map[string]bool, error) {
+	out, err := run(tr, "listing locked packages", "zypper", "-n", "locks")
+	if err != nil {
+		return nil, err
+	}
+	held := map[string]bool{}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Split(line, "|")
+		if len(fields) >= 2 {
+			held[strings.TrimSpace(fields[1])] = true
+		}
+	}
+	return held, nil
+}
+
+// inspectDeb reads the name and version of a .deb file.
+func inspectDeb(tr transport.Transport, path string) (string, string, error) {
+	out, err := run(tr, "inspecting "+path, "dpkg-deb", "--show", "--showformat", "${Package}\t${Version}\n", path)
+	if err != nil {
+		return "", "", err
+	}
+	return packageFileVersion(path, string(out))
+}
+
+// inspectRpm reads the name and version of a .rpm file, with the version as version-release, as queryRpm has it.
+func inspectRpm(tr transport.Transport, path string) (string, string, error) {
+	out, err := run(tr, "inspecting "+path, "rpm", "-qp", "--qf", "%{NAME}\t%{VERSION}-%{RELEASE}\n", path)
+	if err != nil {
+		return "", "", err
+	}
+	return packageFileVersion(path, string(out))
+}
+
+// packageFileVersion parses the single "name<tab>version" line describing the package file at path.
+func packageFileVersion(path, out string) (string, string, error) {
+	versions := tabbedVersions(out, "\t")
+	if len(versions) != 1 {
+		return "", "", fmt.Errorf("%s does not look like a package file", path)
+	}
+	var name, version string
+	for name, version = range versions {
+	}
+	return name, version, nil
+}
+
+// cacheAgeScript prints how many seconds ago $1 was modified, by the target's clock; or exits 3 if it doesn't exist.
+const cacheAgeScript = `s=$(stat -c %Y "$1" 2>/dev/null) || exit 3; echo $(( $(date +%s) - s ))`
+
+// cacheAge returns how long ago the package index was refreshed; or -1 if there's no telling.
+func (pm *packageManager) cacheAge(tr transport.Transport) (time.Duration, error) {
+	out, stderr, res, err := tr.Do([]string{"sh", "-c", cacheAgeScript, "sh", pm.cacheStamp})
+	if err != nil {
+		return 0, fmt.Errorf("checking age of package index: %s", err)
+	}
+	if res == 3 {
+		return -1, nil
+	}
+	if res != 0 {
+		log.Debugf("stderr: %s", string(stderr))
+		return 0, fmt.Errorf("non-zero checking age of package index: %d", res)
+	}
+	secs, err := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("parsing age of package index: %s", err)
+	}
+	return time.Duration(secs) * time.Second, nil
+}
+
+// touchStampScript brings the modification time of $1 up to date, creating it, and its directory, if need be.
+const touchStampScript = `mkdir -p "$(dirname "$1")" && touch "$1"`
@@ -0,0 +1,48 @@
+package module
+
+import (
+	"fmt"
+	"github.com/pdbogen/gosible/transport"
+	"strings"
+)
+
+// run runs cmd on the target, and fails if it can't be run or exits non-zero. what describes the command for error
+// messages, e.g. "creating /var/www". It returns the command's stdout.
+func run(tr transport.Transport, what string, cmd ...string) ([]byte, error) {
+	stdout, stderr, res, err := tr.Do(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", what, err)
+	}
+	if res != 0 {
+		log.Debugf("stderr: %s", string(stderr))
+		return nil, fmt.Errorf("non-zero %s: %d", what, res)
+	}
+	return stdout, nil
+}
+
+// maxArgs is how many paths runBatched passes to a single command, to stay well clear of the target's argument limit.
+const maxArgs = 256
+
+// runBatched runs cmd with paths appended to it, in as many runs as it takes to pass at most maxArgs paths to each.
+func runBatched(tr transport.Transport, what string, paths []string, cmd ...string) error {
+	for len(paths) > 0 {
+		n := len(paths)
+		if n > maxArgs {
+			n = maxArgs
+		}
+		if _, err := run(tr, what, append(append([]string{}, cmd...), paths[:n]...)...); err != nil {
+			return err
+		}
+		paths = paths[n:]
+	}
+	return nil
+}
+
+// nulRecords splits output made of NUL-terminated records. Listings under a directory use these rather than lines, since
+// NUL, unlike a newline, can't appear in a path.
+func nulRecords(out []byte) []string {
+	if len(out) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(string(out), "\x00"), "\x00")
+}
@@ -0,0 +1,181 @@
+package module
+
+import (
+	"errors"
+	"fmt"
+	"github.com/pdbogen/gosible/transport"
+	"github.com/pdbogen/gosible/types"
+	"strconv"
+)
+
+// The states Service can put a service into. Restarting and reloading are things to do rather than states to be in,
+// so they're done every time; they're meant for tasks run only when something they depend on changed.
+const (
+	svcStarted   = "started"
+	svcStopped   = "stopped"
+	svcRestarted = "restarted"
+	svcReloaded  = "reloaded"
+)
+
+// svcActions are the init system actions that Service runs, with how they're described while and after running them.
+var svcActions = map[string]struct{ doing, done string }{
+	"start":   {"starting", "started"},
+	"stop":    {"stopping", "stopped"},
+	"restart": {"restarting", "restarted"},
+	"reload":  {"reloading", "reloaded"},
+}
+
+// Service starts, stops, restarts or reloads a service, and enables or disables it at boot, with whichever init system
+// the target uses: the one named by the init parameter; or else the one recorded by Survey; or else the one Service
+// finds itself.
+type Service struct {
+	init    string
+	name    string
+	state   string
+	enabled *bool
+}
+
+func (s *Service) Configure(_ *types.Target, params map[string]string) error {
+	*s = Service{}
+
+	if s.name = params["name"]; s.name == "" {
+		return errors.New("service configured without name")
+	}
+
+	if init, ok := params["init"]; ok {
+		if _, ok := initSystems[init]; !ok {
+			return fmt.Errorf("unsupported init system %s", init)
+		}
+		s.init = init
+	}
+
+	switch state := params["state"]; state {
+	case "", svcStarted, svcStopped, svcRestarted, svcReloaded:
+		s.state = state
+	default:
+		return fmt.Errorf("unknown service state %s", state)
+	}
+
+	if enabled, ok := params["enabled"]; ok {
+		e, err := strconv.ParseBool(enabled)
+		if err != nil {
+			return fmt.Errorf("parsing enabled %s: %s", enabled, err)
+		}
+		s.enabled = &e
+	}
+
+	if s.state == "" && s.enabled == nil {
+		return fmt.Errorf("service %s configured with neither state nor enabled", s.name)
+	}
+	return nil
+}
+
+// initSystem picks the init system to use, and records it in the target's metadata if it had to be detected, so that
+// later tasks needn't detect it again.
+func (s *Service) initSystem(target *types.Target, tr transport.Transport) (*initSystem, error) {
+	name := s.init
+	if name == "" && target.Metadata != nil {
+		name = target.Metadata["init_system"]
+	}
+	if name == "" {
+		detected, err := detectInitSystem(tr)
+		if err != nil {
+			return nil, err
+		}
+		setMetadata(target, "init_system", detected)
+		name = detected
+	}
+
+	sys, ok := initSystems[name]
+	if !ok {
+		return nil, fmt.Errorf("unsupported init system %s", name)
+	}
+	return sys, nil
+}
+
+// action works out what to do to bring the service to its configured state, if anything. A stopped service is
+// started rather than reloaded, since there's nothing running to reload.
+func (s *Service) action(sys *initSystem, tr transport.Transport) (string, error) {
+	switch s.state {
+	case "":
+		return "", nil
+	case svcRestarted:
+		return "restart", nil
+	}
+	running, err := sys.running(tr, s.name)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case s.state == svcStarted && !running:
+		return "start", nil
+	case s.state == svcStopped && running:
+		return "stop", nil
+	case s.state == svcReloaded && running:
+		return "reload", nil
+	case s.state == svcReloaded:
+		return "start", nil
+	}
+	return "", nil
+}
+
+// Execute reloads the init system's configuration first, if the service's definition changed, so that what follows
+// uses the new one; then enables or disables the service; then starts, stops, restarts or reloads it. Each of these
+// that's done is logged and counts as a change.
+func (s *Service) Execute(target *types.Target, tr transport.Transport) (bool, error) {
+	sys, err := s.initSystem(target, tr)
+	if err != nil {
+		return false, err
+	}
+	changed := false
+
+	if sys.needsReload != nil {
+		needed, err := sys.needsReload(tr, s.name)
+		if err != nil {
+			return false, err
+		}
+		if needed {
+			if _, err := run(tr, "reloading "+sys.name, sys.daemonReload...); err != nil {
+				return false, err
+			}
+			log.Infof("%s: service %s: reloaded %s, since its definition changed", target.Name, s.name, sys.name)
+			changed = true
+		}
+	}
+
+	if s.enabled != nil {
+		enabled, err := sys.enabled(tr, s.name)
+		if err != nil {
+			return false, err
+		}
+		if enabled != *s.enabled {
+			cmd, doing, done := sys.disable(s.name), "disabling", "disabled"
+			if *s.enabled {
+				cmd, doing, done = sys.enable(s.name), "enabling", "enabled"
+			}
+			if _, err := run(tr, doing+" "+s.name, cmd...); err != nil {
+				return false, err
+			}
+			log.Infof("%s: service %s: %s", target.Name, s.name, done)
+			changed = true
+		}
+	}
+
+	action, err := s.action(sys, tr)
+	if err != nil {
+		return false, err
+	}
+	if action != "" {
+		if _, err := run(tr, svcActions[action].doing+" "+s.name, sys.control(s.name, action)...); err != nil {
+			return false, err
+		}
+		log.Infof("%s: service %s: %s", target.Name, s.name, svcActions[action].done)
+		changed = true
+	}
+	return changed, nil
+}
+
+func (*Service) Name() string { return "service" }
+func (*Service) Always() bool { return false }
+
+var _ Module = (*Service)(nil)
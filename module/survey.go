@@ -37,6 +37,18 @@ func (s *Survey) Execute(target *types.Target, tr transport.Transport) (bool, er
 
 	target.Metadata["hostname"] = string(out)
 
+	if pm, err := detectPackageManager(tr); err != nil {
+		log.Debugf("%s: %s", target.Name, err)
+	} else {
+		setMetadata(target, "pkg_manager", pm)
+	}
+
+	if init, err := detectInitSystem(tr); err != nil {
+		log.Debugf("%s: %s", target.Name, err)
+	} else {
+		setMetadata(target, "init_system", init)
+	}
+
 	yaml, _ := yaml.Marshal(target.Metadata)
 	log.Debugf("survey results for %s: %s", target.Name, string(yaml))
 	return false, nil
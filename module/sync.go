@@ -0,0 +1,414 @@
+package module
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/pdbogen/gosible/transport"
+	"github.com/pdbogen/gosible/types"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Sync mirrors a local directory onto the target, transferring only the files whose content differs.
+type Sync struct {
+	source   string
+	dest     string
+	delete   bool
+	rules    []syncRule
+	register string
+}
+
+// syncRule sets the mode and/or ownership of the paths matching a glob. A pattern containing a slash is matched against
+// the whole path, relative to the synced directory; otherwise it's matched against the last element of the path.
+type syncRule struct {
+	pattern string
+	mode    *fileMode
+	owner   string
+	group   string
+}
+
+func (r syncRule) match(rel string) bool {
+	name := rel
+	if !strings.Contains(r.pattern, "/") {
+		name = path.Base(rel)
+	}
+	ok, _ := path.Match(r.pattern, name)
+	return ok
+}
+
+// parseRules parses one rule per line, each a glob followed by mode=, owner= and/or group= settings; e.g.:
+//
+//	*.sh mode=0755
+//	private/* mode=go-rwx owner=root
+func parseRules(spec string) ([]syncRule, error) {
+	var rules []syncRule
+	for _, line := range strings.Split(spec, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) == 1 {
+			return nil, fmt.Errorf("rule %q sets nothing", line)
+		}
+
+		rule := syncRule{pattern: fields[0]}
+		if _, err := path.Match(rule.pattern, ""); err != nil {
+			return nil, fmt.Errorf("rule %q: bad pattern: %s", line, err)
+		}
+		for _, setting := range fields[1:] {
+			kv := strings.SplitN(setting, "=", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("rule %q: expected key=value, not %q", line, setting)
+			}
+			switch kv[0] {
+			case "mode":
+				m, err := parseMode(kv[1])
+				if err != nil {
+					return nil, fmt.Errorf("rule %q: parsing mode %s: %s", line, kv[1], err)
+				}
+				rule.mode = m
+			case "owner":
+				rule.owner = kv[1]
+			case "group":
+				rule.group = kv[1]
+			default:
+				return nil, fmt.Errorf("rule %q: unknown setting %s", line, kv[0])
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func (s *Sync) Configure(target *types.Target, params map[string]string) error {
+	*s = Sync{}
+	src, ok := params["source"]
+	if !ok || src == "" {
+		return errors.New("sync configured without source")
+	}
+	if src[0] != '/' {
+		src = strings.TrimRight(target.Metadata["rootpath"], "/") + "/" + src
+	}
+	if stat, err := os.Stat(src); err != nil {
+		return fmt.Errorf("sync: source %s: %s", src, err)
+	} else if !stat.IsDir() {
+		return fmt.Errorf("sync: source %s is not a directory", src)
+	}
+	s.source = src
+
+	if dst, ok := params["dest"]; !ok || dst == "" {
+		return errors.New("sync configured without destination")
+	} else {
+		s.dest = dst
+		if dst != "/" {
+			s.dest = strings.TrimRight(dst, "/")
+		}
+	}
+
+	if del, ok := params["delete"]; ok {
+		d, err := strconv.ParseBool(del)
+		if err != nil {
+			return fmt.Errorf("parsing delete %s: %s", del, err)
+		}
+		s.delete = d
+	}
+
+	rules, err := parseRules(params["rules"])
+	if err != nil {
+		return fmt.Errorf("sync: %s", err)
+	}
+	s.rules = rules
+	s.register = params["register"]
+	return nil
+}
+
+// localEntry is a file or directory under the source directory.
+type localEntry struct {
+	rel   string // slash-separated, relative to the source directory
+	path  string
+	isDir bool
+	mode  int64
+	hash  string
+}
+
+// walk lists everything under the source directory, parents before their children. Only regular files and directories
+// are synced; anything else is skipped with a warning.
+func (s *Sync) walk() ([]*localEntry, error) {
+	var entries []*localEntry
+	err := filepath.Walk(s.source, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == s.source {
+			return nil
+		}
+		rel, err := filepath.Rel(s.source, p)
+		if err != nil {
+			return err
+		}
+
+		e := &localEntry{
+			rel:   filepath.ToSlash(rel),
+			path:  p,
+			isDir: info.IsDir(),
+			mode:  int64(info.Mode().Perm()),
+		}
+		if info.Mode()&os.ModeSetuid != 0 {
+			e.mode |= 04000
+		}
+		if info.Mode()&os.ModeSetgid != 0 {
+			e.mode |= 02000
+		}
+		if info.Mode()&os.ModeSticky != 0 {
+			e.mode |= 01000
+		}
+
+		if !e.isDir {
+			if !info.Mode().IsRegular() {
+				log.Warningf("sync: skipping %s, which is neither a regular file nor a directory", p)
+				return nil
+			}
+			f, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			h := sha256.New()
+			if _, err := io.Copy(h, f); err != nil {
+				return fmt.Errorf("reading %s: %s", p, err)
+			}
+			e.hash = hex.EncodeToString(h.Sum(nil))
+		}
+		entries = append(entries, e)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("sync: reading %s: %s", s.source, err)
+	}
+	return entries, nil
+}
+
+// remote returns the path on the target that rel, relative to the source directory, is synced to.
+func (s *Sync) remote(rel string) string {
+	return strings.TrimRight(s.dest, "/") + "/" + rel
+}
+
+// remoteEntry is whatever is at some path under dest on the target.
+type remoteEntry struct {
+	stat *fileStat
+	hash string // only for regular files
+}
+
+// syncListScript lists everything under $1, if it's a directory. After a marker line telling an empty directory from a
+// missing one, each entry is printed as "<mode> <uid> <gid> <sha256 or -> <path>\0", only regular files being hashed.
+// stat and sha256sum are run once per path, reading the file from stdin, since BusyBox can't NUL-terminate their output.
+const syncListScript = `[ -d "$1" ] || exit 0
+echo
+find "$1" -mindepth 1 -exec sh -c 'for p; do
+	s=$(stat -c "%f %u %g" "$p") || exit 1
+	h=-
+	if [ -f "$p" ] && [ ! -h "$p" ]; then h=$(sha256sum < "$p") || exit 1; h=${h%% *}; fi
+	printf "%s %s %s\0" "$s" "$h" "$p"
+done' sh {} +`
+
+// list describes everything under dest on the target, keyed by path relative to dest. It returns nil if dest doesn't
+// exist.
+func (s *Sync) list(tr transport.Transport) (map[string]*remoteEntry, error) {
+	out, err := run(tr, "listing "+s.dest, "sh", "-c", syncListScript, "sh", s.dest)
+	if err != nil {
+		return nil, err
+	}
+	if len(out) == 0 {
+		return nil, nil
+	}
+
+	prefix := s.remote("")
+	entries := map[string]*remoteEntry{}
+	for _, record := range nulRecords(out[1:]) {
+		fields := strings.SplitN(record, " ", 5)
+		if len(fields) != 5 {
+			return nil, fmt.Errorf("unexpected listing under %s: %q", s.dest, record)
+		}
+		st, err := parseStat(fields[:3])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", fields[4], err)
+		}
+		e := &remoteEntry{stat: st}
+		if fields[3] != "-" {
+			e.hash = fields[3]
+		}
+		entries[strings.TrimPrefix(fields[4], prefix)] = e
+	}
+	return entries, nil
+}
+
+// resolve looks up every owner and group named by the rules.
+func (s *Sync) resolve(tr transport.Transport) (uids, gids map[string]int, err error) {
+	uids = map[string]int{}
+	gids = map[string]int{}
+	for _, r := range s.rules {
+		if _, ok := uids[r.owner]; r.owner != "" && !ok {
+			if uids[r.owner], err = lookupUser(tr, r.owner); err != nil {
+				return nil, nil, err
+			}
+		}
+		if _, ok := gids[r.group]; r.group != "" && !ok {
+			if gids[r.group], err = lookupGroup(tr, r.group); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	return uids, gids, nil
+}
+
+// want works out the mode and ownership e should have: its local mode, with each matching rule applied in turn; and
+// the owner and group of the last matching rule that sets them, if any.
+func (s *Sync) want(e *localEntry, uids, gids map[string]int) (mode int64, uid, gid *int32) {
+	mode = e.mode
+	for _, r := range s.rules {
+		if !r.match(e.rel) {
+			continue
+		}
+		if r.mode != nil {
+			mode = r.mode.apply(mode, e.isDir)
+		}
+		if r.owner != "" {
+			uid = int32Ptr(int32(uids[r.owner]))
+		}
+		if r.group != "" {
+			gid = int32Ptr(int32(gids[r.group]))
+		}
+	}
+	return mode, uid, gid
+}
+
+// extraneous returns, sorted, the remote paths that aren't wanted and must be removed. Those under a directory that's
+// being removed are left out, since they go with it.
+func extraneous(remote map[string]*remoteEntry, wanted map[string]bool) []string {
+	var extra []string
+	for rel := range remote {
+		if !wanted[rel] {
+			extra = append(extra, rel)
+		}
+	}
+	sort.Strings(extra)
+	var doomed []string
+	for _, rel := range extra {
+		parent := path.Dir(rel)
+		for parent != "." && wanted[parent] {
+			parent = path.Dir(parent)
+		}
+		if parent != "." {
+			continue
+		}
+		doomed = append(doomed, rel)
+	}
+	return doomed
+}
+
+func (s *Sync) Execute(target *types.Target, tr transport.Transport) (bool, error) {
+	local, err := s.walk()
+	if err != nil {
+		return false, err
+	}
+	remote, err := s.list(tr)
+	if err != nil {
+		return false, err
+	}
+	uids, gids, err := s.resolve(tr)
+	if err != nil {
+		return false, err
+	}
+
+	var changed []string
+	if remote == nil {
+		if _, err := run(tr, "creating directory "+s.dest, "mkdir", "-p", s.dest); err != nil {
+			return false, err
+		}
+		changed = append(changed, ".")
+		remote = map[string]*remoteEntry{}
+	}
+
+	wanted := map[string]bool{}
+	attrs := newAttrChanges()
+	for _, e := range local {
+		wanted[e.rel] = true
+		dest := s.remote(e.rel)
+		mode, uid, gid := s.want(e, uids, gids)
+		r := remote[e.rel]
+
+		// Whatever's in the way of a file or directory is replaced.
+		if r != nil && (e.isDir != r.stat.isDir() || (!e.isDir && r.stat.kind != syscall.S_IFREG)) {
+			if _, err := run(tr, "removing "+dest, "rm", "-rf", dest); err != nil {
+				return false, err
+			}
+			for rel := range remote {
+				if strings.HasPrefix(rel, e.rel+"/") {
+					delete(remote, rel)
+				}
+			}
+			r = nil
+		}
+
+		switch {
+		case e.isDir && r == nil:
+			if _, err := run(tr, "creating directory "+dest, "mkdir", dest); err != nil {
+				return false, err
+			}
+			// The mode is set along with everything else's at the end, once the directory's been filled, in case
+			// it's not writable.
+			attrs.add(dest, nil, mode, uid, gid)
+			changed = append(changed, e.rel)
+		case !e.isDir && (r == nil || r.hash != e.hash):
+			var prev *fileStat
+			if r != nil {
+				prev = r.stat
+			}
+			f := &File{state: stateFile, source: &e.path, dest: dest, mode: octalMode(mode), uid: uid, gid: gid}
+			if _, err := f.writeFile(tr, prev); err != nil {
+				return false, fmt.Errorf("sync: %s: %s", dest, err)
+			}
+			changed = append(changed, e.rel)
+		default:
+			if attrs.add(dest, r.stat, mode, uid, gid) {
+				changed = append(changed, e.rel)
+			}
+		}
+	}
+
+	if s.delete {
+		doomed := extraneous(remote, wanted)
+		paths := make([]string, len(doomed))
+		for i, rel := range doomed {
+			paths[i] = s.remote(rel)
+		}
+		if err := runBatched(tr, "removing extraneous files under "+s.dest, paths, "rm", "-rf"); err != nil {
+			return false, err
+		}
+		changed = append(changed, doomed...)
+	}
+
+	if _, err := attrs.apply(tr, s.dest); err != nil {
+		return false, err
+	}
+
+	sort.Strings(changed)
+	for _, rel := range changed {
+		log.Infof("sync: %s changed", path.Clean(s.remote(rel)))
+	}
+	registerResult(target, s.register, "changed", strings.Join(changed, "\n"))
+	return len(changed) > 0, nil
+}
+
+func (*Sync) Name() string { return "sync" }
+func (*Sync) Always() bool { return false }
+
+var _ Module = (*Sync)(nil)
@@ -0,0 +1,92 @@
+package module
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseRules(t *testing.T) {
+	rules, err := parseRules("*.sh mode=0755\n\n  private/* mode=go-rwx owner=root group=wheel  \n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 2 {
+		t.Fatalf("parsed %d rules, want 2", len(rules))
+	}
+	if r := rules[0]; r.pattern != "*.sh" || r.mode.String() != "0755" || r.owner != "" || r.group != "" {
+		t.Errorf("first rule = %+v", r)
+	}
+	if r := rules[1]; r.pattern != "private/*" || r.mode.String() != "go-rwx" || r.owner != "root" || r.group != "wheel" {
+		t.Errorf("second rule = %+v", r)
+	}
+
+	for _, spec := range []string{
+		"*.sh",
+		"*.sh mode",
+		"*.sh mode=9",
+		"*.sh colour=blue",
+		"[ mode=0644",
+	} {
+		if _, err := parseRules(spec); err == nil {
+			t.Errorf("parseRules(%q) succeeded, want an error", spec)
+		}
+	}
+}
+
+func TestSyncRuleMatch(t *testing.T) {
+	tests := []struct {
+		pattern, rel string
+		want         bool
+	}{
+		{"*.sh", "run.sh", true},
+		{"*.sh", "bin/run.sh", true},
+		{"*.sh", "run.shx", false},
+		{"bin/*", "bin/run.sh", true},
+		{"bin/*", "sub/bin/run.sh", false},
+		{"bin/*", "bin/sub/run.sh", false},
+		{"private", "a/private", true},
+	}
+	for _, test := range tests {
+		if got := (syncRule{pattern: test.pattern}).match(test.rel); got != test.want {
+			t.Errorf("%q matching %q = %t, want %t", test.pattern, test.rel, got, test.want)
+		}
+	}
+}
+
+func TestExtraneous(t *testing.T) {
+	tests := []struct {
+		name   string
+		remote []string
+		wanted []string
+		want   []string
+	}{
+		{"nothing extra", []string{"a", "a/b"}, []string{"a", "a/b"}, nil},
+		{"extra file", []string{"a", "a/b", "c"}, []string{"a", "a/b"}, []string{"c"}},
+		{"extra in wanted dir", []string{"a", "a/b", "a/c"}, []string{"a", "a/b"}, []string{"a/c"}},
+		{
+			"extra dir removed whole",
+			[]string{"a", "x", "x/y", "x/y/z", "x/w"},
+			[]string{"a"},
+			[]string{"x"},
+		},
+		{
+			"nested extra dir",
+			[]string{"a", "a/x", "a/x/y", "b"},
+			[]string{"a", "b"},
+			[]string{"a/x"},
+		},
+	}
+	for _, test := range tests {
+		remote := map[string]*remoteEntry{}
+		for _, rel := range test.remote {
+			remote[rel] = &remoteEntry{}
+		}
+		wanted := map[string]bool{}
+		for _, rel := range test.wanted {
+			wanted[rel] = true
+		}
+		if got := extraneous(remote, wanted); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
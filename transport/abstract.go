@@ -3,9 +3,14 @@ package transport
 import (
 	"github.com/pdbogen/gosible/types"
 	"io"
+	"os"
 )
 
-type TransportConnect func(*types.Target, *types.Credential) (Transport, error)
+// CredentialSource returns the credentials to try, in order, when logging in to the given target. Transports that
+// reach other hosts along the way (e.g., SSH jump hosts) use it for those as well.
+type CredentialSource func(*types.Target) ([]*types.Credential, error)
+
+type TransportConnect func(*types.Target, CredentialSource) (Transport, error)
 
 type Transport interface {
 	// Do performs a command via the configured transport, probably on a target host. The first element in cmd
@@ -13,6 +18,14 @@ type Transport interface {
 	Do(cmd []string) (stdout []byte, stderr []byte, result int, err error)
 	DoInput(cmd []string, stdin []byte) (stdout []byte, stderr []byte, result int, err error)
 	DoReader(cmd []string, stdin io.Reader) (stdout []byte, stderr []byte, result int, err error)
-	Connect(target *types.Target, credential *types.Credential) (Transport, error)
+	// DoStream is like DoReader, but copies the command's output to stdout and stderr as it arrives, rather than
+	// collecting it in memory.
+	DoStream(cmd []string, stdin io.Reader, stdout, stderr io.Writer) (result int, err error)
+	// Put streams content into the file at path on the target, creating or truncating it. A new file is created with
+	// the given mode; the mode of an existing file is left alone, as with open(2).
+	Put(path string, content io.Reader, mode os.FileMode) error
+	// Get streams the content of the file at path on the target into w.
+	Get(path string, w io.Writer) error
+	Connect(target *types.Target, credentials CredentialSource) (Transport, error)
 	Close()
 }
@@ -0,0 +1,164 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"github.com/pdbogen/gosible/types"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+)
+
+// sshAuth collects credentials, in order, into runs of the same kind of authentication. The ssh package tries each
+// kind at most once per connection, so a run's credentials are offered together: all of its keys (including those from
+// agents) by one publickey method, and all of its passwords by one retryable password method.
+type sshAuth struct {
+	runs    []*authRun
+	closers []io.Closer
+}
+
+type authRun struct {
+	kind      string
+	signers   []func() ([]ssh.Signer, error)
+	passwords []string
+}
+
+// authAttempts groups the runs of the given credentials into attempts at authentication, to be made one after another,
+// each on a connection of its own. It also returns anything (e.g., agent sockets) that must be closed once the
+// connection is finished with. An attempt takes runs, in order, until one would repeat a kind already in it: e.g., with
+// a password, a key and then another password, the first password and the key are tried on one connection, and the
+// second password on the next.
+func authAttempts(creds []*types.Credential) ([][]*authRun, []io.Closer, error) {
+	a := &sshAuth{}
+	for _, cred := range creds {
+		if err := a.add(cred); err != nil {
+			a.close()
+			return nil, nil, fmt.Errorf("credential %s: %s", cred.Name, err)
+		}
+	}
+
+	var attempts [][]*authRun
+	var kinds map[string]bool
+	for _, run := range a.runs {
+		if len(attempts) == 0 || kinds[run.kind] {
+			attempts = append(attempts, nil)
+			kinds = map[string]bool{}
+		}
+		kinds[run.kind] = true
+		attempts[len(attempts)-1] = append(attempts[len(attempts)-1], run)
+	}
+	return attempts, a.closers, nil
+}
+
+// use returns the run that the next credential of the given kind belongs to: the last one, if it's of the same kind;
+// otherwise a new one.
+func (a *sshAuth) use(kind string) *authRun {
+	if len(a.runs) == 0 || a.runs[len(a.runs)-1].kind != kind {
+		a.runs = append(a.runs, &authRun{kind: kind})
+	}
+	return a.runs[len(a.runs)-1]
+}
+
+func (a *sshAuth) close() {
+	for _, c := range a.closers {
+		c.Close()
+	}
+}
+
+func (a *sshAuth) add(cred *types.Credential) error {
+	switch cred.Kind() {
+	case types.CredentialPassword:
+		run := a.use("password")
+		run.passwords = append(run.passwords, cred.Value)
+	case types.CredentialKey:
+		signer, err := parseKey(cred)
+		if err != nil {
+			return err
+		}
+		run := a.use("publickey")
+		run.signers = append(run.signers, func() ([]ssh.Signer, error) { return []ssh.Signer{signer}, nil })
+	case types.CredentialAgent:
+		sock := cred.Path
+		if sock == "" {
+			sock = os.Getenv("SSH_AUTH_SOCK")
+		}
+		if sock == "" {
+			return errors.New("no agent socket given, and SSH_AUTH_SOCK is not set")
+		}
+		conn, err := net.Dial("unix", sock)
+		if err != nil {
+			return fmt.Errorf("connecting to agent at %s: %s", sock, err)
+		}
+		a.closers = append(a.closers, conn)
+		run := a.use("publickey")
+		run.signers = append(run.signers, agent.NewClient(conn).Signers)
+	default:
+		return fmt.Errorf("unknown credential type '%s'", cred.Type)
+	}
+	return nil
+}
+
+// method returns a fresh ssh.AuthMethod for the run's credentials, for use on a single connection.
+func (r *authRun) method() ssh.AuthMethod {
+	if r.kind == "password" {
+		return ssh.RetryableAuthMethod(ssh.PasswordCallback(r.nextPassword()), len(r.passwords))
+	}
+	return ssh.PublicKeysCallback(r.publicKeys)
+}
+
+// publicKeys gathers every key in the run, in credential order. An agent that fails is skipped, rather than failing the
+// others.
+func (r *authRun) publicKeys() ([]ssh.Signer, error) {
+	signers := []ssh.Signer{}
+	for _, get := range r.signers {
+		s, err := get()
+		if err != nil {
+			log.Warningf("retrieving keys: %s", err)
+			continue
+		}
+		signers = append(signers, s...)
+	}
+	return signers, nil
+}
+
+func (r *authRun) nextPassword() func() (string, error) {
+	i := 0
+	return func() (string, error) {
+		if i >= len(r.passwords) {
+			return "", errors.New("no more passwords")
+		}
+		i++
+		return r.passwords[i-1], nil
+	}
+}
+
+func parseKey(cred *types.Credential) (ssh.Signer, error) {
+	pem := []byte(cred.Value)
+	if cred.Value == "" {
+		if cred.Path == "" {
+			return nil, errors.New("key credential has neither value nor path")
+		}
+		var err error
+		pem, err = ioutil.ReadFile(cred.Path)
+		if err != nil {
+			return nil, fmt.Errorf("reading key: %s", err)
+		}
+	}
+
+	if cred.Passphrase != "" {
+		signer, err := ssh.ParsePrivateKeyWithPassphrase(pem, []byte(cred.Passphrase))
+		if err != nil {
+			return nil, fmt.Errorf("parsing encrypted key: %s", err)
+		}
+		return signer, nil
+	}
+
+	signer, err := ssh.ParsePrivateKey(pem)
+	if err != nil {
+		return nil, fmt.Errorf("parsing key: %s", err)
+	}
+	return signer, nil
+}
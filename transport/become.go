@@ -0,0 +1,229 @@
+package transport
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/pdbogen/gosible/types"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// sudoPrompt is passed to `sudo -p`, so that we can recognize and strip the password prompt from stderr.
+const sudoPrompt = "[gosible-become] "
+
+// Become wraps another Transport, so that every command sent through it is run as a different user, via sudo or su.
+// Because commands run as that user, files written through it (including by Put) are owned by that user as well.
+type Become struct {
+	Transport
+	User     string
+	Method   string
+	Password string
+}
+
+// NewBecome wraps tr such that commands are run according to the escalation settings in b. If b does not enable
+// escalation, tr is returned unchanged.
+func NewBecome(tr Transport, b types.Become, password string) (Transport, error) {
+	if !b.Enabled() {
+		return tr, nil
+	}
+
+	become := &Become{
+		Transport: tr,
+		User:      b.User,
+		Method:    b.Method,
+		Password:  password,
+	}
+	if become.User == "" {
+		become.User = "root"
+	}
+	if become.Method == "" {
+		become.Method = "sudo"
+	}
+	if become.Method != "sudo" && become.Method != "su" {
+		return nil, fmt.Errorf("unsupported become method '%s'", become.Method)
+	}
+	// su reads a password only from a terminal, which commands run through a Transport don't have.
+	if become.Method == "su" && password != "" {
+		return nil, fmt.Errorf("become method su cannot be given a password; log in as root, or use sudo")
+	}
+	return become, nil
+}
+
+func (b *Become) Do(cmd []string) (stdout []byte, stderr []byte, result int, err error) {
+	return b.DoInput(cmd, []byte{})
+}
+
+func (b *Become) DoInput(cmd []string, stdin []byte) (stdout []byte, stderr []byte, result int, err error) {
+	return b.DoReader(cmd, bytes.NewBuffer(stdin))
+}
+
+func (b *Become) DoReader(cmd []string, stdin io.Reader) (stdout []byte, stderr []byte, result int, err error) {
+	outBuf := bytes.Buffer{}
+	errBuf := bytes.Buffer{}
+	result, err = b.DoStream(cmd, stdin, &outBuf, &errBuf)
+	if err != nil {
+		return nil, nil, result, err
+	}
+	return outBuf.Bytes(), errBuf.Bytes(), result, nil
+}
+
+func (b *Become) DoStream(cmd []string, stdin io.Reader, stdout, stderr io.Writer) (result int, err error) {
+	if b == nil || b.Transport == nil {
+		return 255, fmt.Errorf("Become.Do called with nil transport")
+	}
+
+	var wrapped []string
+	switch b.Method {
+	case "sudo":
+		wrapped, stdin, err = b.sudo(cmd, stdin)
+		if err != nil {
+			return 255, err
+		}
+	case "su":
+		return b.Transport.DoStream(b.su(cmd), stdin, stdout, stderr)
+	default:
+		return 255, fmt.Errorf("unsupported become method '%s'", b.Method)
+	}
+
+	filter := &promptFilter{w: stderr}
+	result, err = b.Transport.DoStream(wrapped, stdin, stdout, filter)
+	if flushErr := filter.Flush(); err == nil && flushErr != nil {
+		return result, flushErr
+	}
+	return result, err
+}
+
+// promptFilter drops the sudo password prompt from the start of stderr, passing everything else through.
+type promptFilter struct {
+	w    io.Writer
+	seen []byte
+	done bool
+}
+
+func (p *promptFilter) Write(b []byte) (int, error) {
+	if p.done {
+		return p.w.Write(b)
+	}
+
+	p.seen = append(p.seen, b...)
+	if len(p.seen) < len(sudoPrompt) && bytes.HasPrefix([]byte(sudoPrompt), p.seen) {
+		// Could still be the prompt; wait for more.
+		return len(b), nil
+	}
+
+	p.done = true
+	rest := bytes.TrimPrefix(p.seen, []byte(sudoPrompt))
+	p.seen = nil
+	if len(rest) > 0 {
+		if _, err := p.w.Write(rest); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// Flush writes out whatever was held back for looking like the start of the prompt; once the command has exited, it
+// can't be. It must be called when the command is done.
+func (p *promptFilter) Flush() error {
+	p.done = true
+	if len(p.seen) == 0 {
+		return nil
+	}
+	seen := p.seen
+	p.seen = nil
+	_, err := p.w.Write(seen)
+	return err
+}
+
+// sudoProbes caches, for each underlying transport and user, whether sudo wants a password. It's asked once, rather
+// than before every command, since a Become is made afresh for every task.
+var sudoProbes = struct {
+	sync.Mutex
+	needsPassword map[sudoProbe]bool
+}{needsPassword: map[sudoProbe]bool{}}
+
+type sudoProbe struct {
+	tr   Transport
+	user string
+}
+
+// needsPassword asks sudo non-interactively whether it will let us through without a password.
+func (b *Become) needsPassword() (bool, error) {
+	key := sudoProbe{b.Transport, b.User}
+	sudoProbes.Lock()
+	defer sudoProbes.Unlock()
+	if needs, ok := sudoProbes.needsPassword[key]; ok {
+		return needs, nil
+	}
+
+	_, _, res, err := b.Transport.Do([]string{"sudo", "-n", "-u", b.User, "true"})
+	if err != nil {
+		return false, fmt.Errorf("checking whether sudo requires a password: %s", err)
+	}
+	sudoProbes.needsPassword[key] = res != 0
+	return res != 0, nil
+}
+
+// sudo wraps cmd in a sudo invocation. sudo only reads a password when it actually needs one; if we were to send a
+// password anyway, it would end up on the command's stdin. So we first find out whether it needs one.
+func (b *Become) sudo(cmd []string, stdin io.Reader) ([]string, io.Reader, error) {
+	wrapped := []string{"sudo", "-H", "-u", b.User}
+	if b.Password != "" {
+		needs, err := b.needsPassword()
+		if err != nil {
+			return nil, nil, err
+		}
+		if needs {
+			wrapped = append(wrapped, "-S", "-p", sudoPrompt)
+			stdin = io.MultiReader(strings.NewReader(b.Password+"\n"), stdin)
+		} else {
+			wrapped = append(wrapped, "-n")
+		}
+	} else {
+		wrapped = append(wrapped, "-n")
+	}
+	wrapped = append(wrapped, "--")
+	return append(wrapped, cmd...), stdin, nil
+}
+
+// su wraps cmd in an su invocation. su takes a single shell command rather than an argument list, so every element
+// of cmd is escaped here. It only works without a password, i.e. when logged in as root; see NewBecome.
+func (b *Become) su(cmd []string) []string {
+	escaped := make([]string, len(cmd))
+	for i, arg := range cmd {
+		escaped[i] = escape(arg)
+	}
+	return []string{"su", "-s", "/bin/sh", "-c", strings.Join(escaped, " "), b.User}
+}
+
+// putScript writes stdin to $1; creating it first, with mode $2, if it doesn't exist. It's used by Put, since SFTP
+// can't run as another user.
+const putScript = `[ -e "$1" ] || { (umask 077 && : > "$1") && chmod "$2" "$1"; } || exit 1; exec cat > "$1"`
+
+func (b *Become) Put(path string, content io.Reader, mode os.FileMode) error {
+	_, stderr, res, err := b.DoReader([]string{"sh", "-c", putScript, "sh", path, fmt.Sprintf("%04o", mode)}, content)
+	if err != nil {
+		return fmt.Errorf("writing %s: %s", path, err)
+	}
+	if res != 0 {
+		return fmt.Errorf("non-zero writing %s: %d: %s", path, res, strings.TrimSpace(string(stderr)))
+	}
+	return nil
+}
+
+// Get streams the file through cat straight into w, rather than holding all of it in memory.
+func (b *Become) Get(path string, w io.Writer) error {
+	stderr := &bytes.Buffer{}
+	res, err := b.DoStream([]string{"cat", path}, &bytes.Buffer{}, w, stderr)
+	if err != nil {
+		return fmt.Errorf("reading %s: %s", path, err)
+	}
+	if res != 0 {
+		return fmt.Errorf("non-zero reading %s: %d: %s", path, res, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+var _ Transport = (*Become)(nil)
@@ -0,0 +1,36 @@
+package transport
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPromptFilter(t *testing.T) {
+	tests := []struct {
+		name   string
+		writes []string
+		want   string
+	}{
+		{"prompt then error", []string{sudoPrompt, "oops\n"}, "oops\n"},
+		{"prompt in pieces", []string{sudoPrompt[:3], sudoPrompt[3:] + "oops\n"}, "oops\n"},
+		{"no prompt", []string{"error: ", "no such file\n"}, "error: no such file\n"},
+		{"short, prompt-like stderr", []string{"["}, "["},
+		{"longer prompt-like stderr", []string{"[g", "o"}, "[go"},
+		{"nothing", nil, ""},
+	}
+	for _, test := range tests {
+		var out bytes.Buffer
+		p := &promptFilter{w: &out}
+		for _, w := range test.writes {
+			if _, err := p.Write([]byte(w)); err != nil {
+				t.Fatalf("%s: %s", test.name, err)
+			}
+		}
+		if err := p.Flush(); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if out.String() != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, out.String(), test.want)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package transport
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"github.com/pdbogen/gosible/types"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Chroot runs commands via chroot(8) inside a directory on the local machine, which is given as the target's address.
+// It's meant for building root filesystems for VM and container images. If the target names an Archive, the tree is
+// packed into it when the transport is closed.
+type Chroot struct {
+	Local
+	Root    string
+	Archive string
+}
+
+// Connect, like SSH.Connect, can be called on a nil pointer. No credentials are needed, but gosible must be running as
+// root for chroot to work.
+func (*Chroot) Connect(target *types.Target, _ CredentialSource) (Transport, error) {
+	if target == nil {
+		return nil, fmt.Errorf("Chroot.Connect called with nil target")
+	}
+	if target.Address == "" {
+		return nil, fmt.Errorf("chroot target %s has no address", target.Name)
+	}
+
+	root, err := filepath.Abs(target.Address)
+	if err != nil {
+		return nil, fmt.Errorf("resolving chroot %s: %s", target.Address, err)
+	}
+	if stat, err := os.Stat(root); err != nil {
+		return nil, fmt.Errorf("chroot %s: %s", root, err)
+	} else if !stat.IsDir() {
+		return nil, fmt.Errorf("chroot %s is not a directory", root)
+	}
+
+	return &Chroot{
+		Local:   Local{chroot: root},
+		Root:    root,
+		Archive: target.Archive,
+	}, nil
+}
+
+func (c *Chroot) Close() {
+	if c.Archive == "" {
+		return
+	}
+	log.Infof("packing %s into %s", c.Root, c.Archive)
+	if err := c.pack(); err != nil {
+		log.Errorf("packing %s into %s: %s", c.Root, c.Archive, err)
+	}
+}
+
+// pack writes the whole tree to c.Archive, gzipped if its name ends in .gz or .tgz. Ownership and permissions are
+// preserved, and paths are relative to the root. If anything fails, including the final flush of the archive, the
+// error is returned, so that a truncated archive isn't taken for a good one.
+func (c *Chroot) pack() (err error) {
+	archive, err := filepath.Abs(c.Archive)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(archive)
+	if err != nil {
+		return err
+	}
+
+	// Each writer is closed before the one under it, and the first error is the one returned.
+	closers := []io.Closer{f}
+	defer func() {
+		for i := len(closers) - 1; i >= 0; i-- {
+			if closeErr := closers[i].Close(); err == nil && closeErr != nil {
+				err = fmt.Errorf("finishing %s: %s", archive, closeErr)
+			}
+		}
+	}()
+
+	var w io.Writer = f
+	if strings.HasSuffix(c.Archive, ".gz") || strings.HasSuffix(c.Archive, ".tgz") {
+		gz := gzip.NewWriter(f)
+		closers = append(closers, gz)
+		w = gz
+	}
+	tw := tar.NewWriter(w)
+	closers = append(closers, tw)
+
+	return filepath.Walk(c.Root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == archive {
+			return nil
+		}
+		rel, err := filepath.Rel(c.Root, path)
+		if err != nil {
+			return err
+		}
+
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			// Sockets, mostly, which some daemon left behind; they'd be useless in an image anyway.
+			log.Warningf("not packing %s: %s", path, err)
+			return nil
+		}
+		// FileInfoHeader names the owner from this machine's user database, which may not agree with the tree's; and
+		// extractors prefer names to IDs. So leave only the IDs.
+		hdr.Uname, hdr.Gname = "", ""
+		hdr.Name = "./"
+		if rel != "." {
+			hdr.Name += filepath.ToSlash(rel)
+			if info.IsDir() {
+				hdr.Name += "/"
+			}
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		in, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		if _, err := io.Copy(tw, in); err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+		return nil
+	})
+}
+
+var _ Transport = (*Chroot)(nil)
@@ -0,0 +1,110 @@
+package transport
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestChrootPack(t *testing.T) {
+	root, err := ioutil.TempDir("", "gosible-pack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	file := filepath.Join(root, "file")
+	if err := ioutil.WriteFile(file, []byte("content"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	owned := os.Getuid() == 0
+	if owned {
+		if err := os.Chown(file, 4242, 4243); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sock, err := net.Listen("unix", filepath.Join(root, "sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sock.Close()
+
+	archive := filepath.Join(root, "out.tgz")
+	c := &Chroot{Root: root, Archive: archive}
+	if err := c.pack(); err != nil {
+		t.Fatalf("pack: %s", err)
+	}
+
+	f, err := os.Open(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+	names := map[string]*tar.Header{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("reading archive: %s", err)
+		}
+		names[hdr.Name] = hdr
+	}
+
+	if _, ok := names["./sock"]; ok {
+		t.Errorf("socket was packed")
+	}
+	hdr, ok := names["./file"]
+	if !ok {
+		t.Fatalf("file was not packed; got %v", names)
+	}
+	if hdr.Uname != "" || hdr.Gname != "" {
+		t.Errorf("file packed with owner names %q:%q; want IDs only", hdr.Uname, hdr.Gname)
+	}
+	if owned && (hdr.Uid != 4242 || hdr.Gid != 4243) {
+		t.Errorf("file packed with owner %d:%d, want 4242:4243", hdr.Uid, hdr.Gid)
+	}
+}
+
+// TestChrootPackReportsFlushError checks that an error that only shows up when the archive is finished, as when the
+// disk fills up, isn't lost.
+func TestChrootPackReportsFlushError(t *testing.T) {
+	if _, err := os.Stat("/dev/full"); err != nil {
+		t.Skip("no /dev/full")
+	}
+	root, err := ioutil.TempDir("", "gosible-pack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	if err := ioutil.WriteFile(filepath.Join(root, "file"), []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// gzip buffers everything this small until it's closed.
+	out, err := ioutil.TempDir("", "gosible-pack-out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(out)
+	archive := filepath.Join(out, "full.tgz")
+	if err := os.Symlink("/dev/full", archive); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &Chroot{Root: root, Archive: archive}
+	if err := c.pack(); err == nil {
+		t.Errorf("pack to /dev/full succeeded")
+	}
+}
@@ -1,24 +1,11 @@
 package transport
 
 import (
-	"encoding/base64"
-	"fmt"
-	"regexp"
+	"strings"
 )
 
-var safeRe, safeReErr = regexp.Compile("^[^']+$")
-
-func init() {
-	if safeReErr != nil {
-		panic(safeReErr)
-	}
-}
-
+// escape quotes in for a POSIX shell, so that it's passed as exactly one word, whatever it contains: each single quote
+// in it ends the quoted string, is itself backslash-escaped, and starts a new one.
 func escape(in string) string {
-	if safeRe.MatchString(in) {
-		return fmt.Sprintf("'%s'", in)
-	}
-
-	b64 := base64.StdEncoding.EncodeToString([]byte(in))
-	return fmt.Sprintf("$(echo '%s' | base64 -w0 -d)", b64)
+	return "'" + strings.Replace(in, "'", `'\''`, -1) + "'"
 }
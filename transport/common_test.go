@@ -0,0 +1,29 @@
+package transport
+
+import (
+	"os/exec"
+	"testing"
+)
+
+func TestEscape(t *testing.T) {
+	tests := []string{
+		"plain",
+		"",
+		"two words",
+		"it's",
+		"'",
+		"''",
+		`awk '$1 == g { print $3 }'`,
+		"$HOME `id` $(id) \\ \" \n *",
+	}
+	for _, in := range tests {
+		out, err := exec.Command("sh", "-c", `printf %s `+escape(in)).Output()
+		if err != nil {
+			t.Errorf("%q: %s", in, err)
+			continue
+		}
+		if string(out) != in {
+			t.Errorf("%q came out of the shell as %q", in, out)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package transport
+
+import (
+	"fmt"
+	"github.com/pdbogen/gosible/types"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Host key policies; see types.Target.HostKeyPolicy.
+const (
+	HostKeyStrict   = "strict"
+	HostKeyTOFU     = "tofu"
+	HostKeyInsecure = "insecure"
+)
+
+// knownHostsMu serializes additions to known_hosts files, since several connections may be trusting new keys at once.
+var knownHostsMu sync.Mutex
+
+// defaultHostKeyAlgos is x/crypto/ssh's own order of preference for host key algorithms, which it doesn't export.
+var defaultHostKeyAlgos = []string{
+	ssh.CertAlgoRSASHA512v01, ssh.CertAlgoRSASHA256v01,
+	ssh.CertAlgoRSAv01, ssh.CertAlgoDSAv01, ssh.CertAlgoECDSA256v01,
+	ssh.CertAlgoECDSA384v01, ssh.CertAlgoECDSA521v01, ssh.CertAlgoED25519v01,
+	ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521,
+	ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256,
+	ssh.KeyAlgoRSA, ssh.KeyAlgoDSA,
+	ssh.KeyAlgoED25519,
+}
+
+// keyAlgos returns the algorithms that a host key of the given type may sign with, best first. An RSA key can sign
+// with SHA-2 as well as with the SHA-1 of its type's name; and servers that have dropped SHA-1 only offer SHA-2.
+func keyAlgos(keyType string) []string {
+	switch keyType {
+	case ssh.KeyAlgoRSA:
+		return []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+	case ssh.CertAlgoRSAv01:
+		return []string{ssh.CertAlgoRSASHA512v01, ssh.CertAlgoRSASHA256v01, ssh.CertAlgoRSAv01}
+	}
+	return []string{keyType}
+}
+
+// preferAlgos returns defaultHostKeyAlgos with the algorithms for the given key types moved to the front, as OpenSSH
+// does with the types it has recorded for a host. Otherwise, the server may well present a type of key that isn't
+// recorded, even though another type is; which looks just like a changed key. It returns nil, meaning the default, if
+// types is empty.
+func preferAlgos(types []string) []string {
+	if len(types) == 0 {
+		return nil
+	}
+	var algos []string
+	preferred := map[string]bool{}
+	for _, t := range types {
+		for _, algo := range keyAlgos(t) {
+			if !preferred[algo] {
+				preferred[algo] = true
+				algos = append(algos, algo)
+			}
+		}
+	}
+	for _, algo := range defaultHostKeyAlgos {
+		if !preferred[algo] {
+			algos = append(algos, algo)
+		}
+	}
+	return algos
+}
+
+// probeKey is a key that's never in known_hosts; checking it lists the keys that are recorded for a host.
+type probeKey struct{}
+
+func (probeKey) Type() string                        { return "gosible-probe" }
+func (probeKey) Marshal() []byte                     { return []byte("gosible-probe") }
+func (probeKey) Verify([]byte, *ssh.Signature) error { return fmt.Errorf("probe key cannot verify") }
+
+// probeAddr is the address, host:port, being checked for, standing in for the remote address of a connection.
+type probeAddr string
+
+func (probeAddr) Network() string  { return "tcp" }
+func (a probeAddr) String() string { return string(a) }
+
+// recordedKeyTypes returns the types of the keys that check knows for address.
+func recordedKeyTypes(check ssh.HostKeyCallback, address string) []string {
+	keyErr, ok := check(address, probeAddr(address), probeKey{}).(*knownhosts.KeyError)
+	if !ok {
+		return nil
+	}
+	var types []string
+	for _, k := range keyErr.Want {
+		types = append(types, k.Key.Type())
+	}
+	sort.Strings(types)
+	return types
+}
+
+// hostKeyCallback returns the ssh.HostKeyCallback for the target, and the host key types to ask for, in order of
+// preference. A HostKey given on the target always wins; otherwise the key is checked against a known_hosts file
+// according to the target's HostKeyPolicy.
+func hostKeyCallback(target *types.Target) (ssh.HostKeyCallback, []string, error) {
+	if target.HostKey != nil {
+		key, err := ssh.ParsePublicKey([]byte(*target.HostKey))
+		if err != nil {
+			return nil, nil, fmt.Errorf("provided host key for target %s@%s:%d could not be parsed: %s", target.User, target.Address, target.Port, err)
+		}
+		return ssh.FixedHostKey(key), preferAlgos([]string{key.Type()}), nil
+	}
+
+	policy := target.HostKeyPolicy
+	if policy == "" {
+		policy = HostKeyTOFU
+	}
+	if policy == HostKeyInsecure {
+		log.Warningf("host key checking disabled for target %s", target.Name)
+		return ssh.InsecureIgnoreHostKey(), nil, nil
+	}
+	if policy != HostKeyStrict && policy != HostKeyTOFU {
+		return nil, nil, fmt.Errorf("unknown host key policy '%s' for target %s", policy, target.Name)
+	}
+
+	path, err := knownHostsPath(target.KnownHosts)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if policy == HostKeyTOFU {
+		if err := ensureFile(path); err != nil {
+			return nil, nil, fmt.Errorf("preparing known_hosts %s: %s", path, err)
+		}
+	}
+
+	knownHostsMu.Lock()
+	check, err := knownhosts.New(path)
+	knownHostsMu.Unlock()
+	if err != nil {
+		return nil, nil, fmt.Errorf("reading known_hosts %s: %s", path, err)
+	}
+	algos := preferAlgos(recordedKeyTypes(check, sshAddress(target)))
+
+	// check knows only what was in known_hosts when it was read; keys trusted since are remembered here, so that a
+	// reconnect doesn't record them again.
+	var trustedMu sync.Mutex
+	trusted := map[string]bool{}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		entry := knownhosts.Normalize(hostname) + " " + string(key.Marshal())
+		trustedMu.Lock()
+		defer trustedMu.Unlock()
+		if trusted[entry] {
+			return nil
+		}
+
+		err := check(hostname, remote, key)
+		keyErr, ok := err.(*knownhosts.KeyError)
+		if !ok {
+			return err
+		}
+
+		if len(keyErr.Want) > 0 {
+			want := make([]string, len(keyErr.Want))
+			for i, k := range keyErr.Want {
+				want[i] = fmt.Sprintf("%s (%s:%d)", ssh.FingerprintSHA256(k.Key), k.Filename, k.Line)
+			}
+			return fmt.Errorf("HOST KEY FOR %s HAS CHANGED: presented %s %s, but expected %s",
+				hostname, key.Type(), ssh.FingerprintSHA256(key), strings.Join(want, ", "))
+		}
+
+		if policy != HostKeyTOFU {
+			return fmt.Errorf("host key %s %s for %s is not in %s", key.Type(), ssh.FingerprintSHA256(key), hostname, path)
+		}
+
+		log.Warningf("trusting new host key %s %s for %s, recording in %s", key.Type(), ssh.FingerprintSHA256(key), hostname, path)
+		if err := appendKnownHost(path, hostname, key); err != nil {
+			return err
+		}
+		trusted[entry] = true
+		return nil
+	}, algos, nil
+}
+
+// knownHostsPath expands a leading ~ in path; an empty path means the user's own known_hosts.
+func knownHostsPath(path string) (string, error) {
+	if path == "" {
+		path = "~/.ssh/known_hosts"
+	}
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		home := os.Getenv("HOME")
+		if home == "" {
+			return "", fmt.Errorf("cannot expand %s: HOME is not set", path)
+		}
+		path = filepath.Join(home, path[1:])
+	}
+	return path, nil
+}
+
+func ensureFile(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDONLY, 0600)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func appendKnownHost(path, hostname string, key ssh.PublicKey) error {
+	knownHostsMu.Lock()
+	defer knownHostsMu.Unlock()
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("recording host key: %s", err)
+	}
+	defer f.Close()
+
+	if _, err := fmt.Fprintln(f, knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key)); err != nil {
+		return fmt.Errorf("recording host key: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package transport
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"github.com/pdbogen/gosible/types"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// TestHostKeyPrefersRecordedType checks that a host recorded only by its ed25519 key is verified by that key, even
+// though the server also has an ECDSA key, which x/crypto/ssh would otherwise prefer.
+func TestHostKeyPrefersRecordedType(t *testing.T) {
+	_, edPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edSigner, err := ssh.NewSignerFromKey(edPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecPriv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecSigner, err := ssh.NewSignerFromKey(ecPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "gosible-hostkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize("example.com:2222")}, edSigner.PublicKey())
+	if err := ioutil.WriteFile(path, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	target := &types.Target{Name: "t", Address: "example.com", Port: 2222, KnownHosts: path, HostKeyPolicy: HostKeyStrict}
+	cb, algos, err := hostKeyCallback(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(algos) == 0 || algos[0] != ssh.KeyAlgoED25519 {
+		t.Fatalf("host key algorithms = %v, want %s first", algos, ssh.KeyAlgoED25519)
+	}
+
+	server := &ssh.ServerConfig{NoClientAuth: true}
+	server.AddHostKey(ecSigner)
+	server.AddHostKey(edSigner)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		ssh.NewServerConn(conn, server)
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := &ssh.ClientConfig{User: "u", HostKeyCallback: cb, HostKeyAlgorithms: algos}
+	c, _, _, err := ssh.NewClientConn(conn, "example.com:2222", client)
+	if err != nil {
+		t.Fatalf("handshake: %s", err)
+	}
+	c.Close()
+}
+
+func TestPreferAlgos(t *testing.T) {
+	if algos := preferAlgos(nil); algos != nil {
+		t.Errorf("preferAlgos(nil) = %v, want nil", algos)
+	}
+	algos := preferAlgos([]string{ssh.KeyAlgoED25519, ssh.KeyAlgoRSA})
+	if len(algos) != len(defaultHostKeyAlgos) {
+		t.Errorf("preferAlgos returned %d algorithms, want %d", len(algos), len(defaultHostKeyAlgos))
+	}
+	want := []string{ssh.KeyAlgoED25519, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+	if len(algos) < len(want) || !reflect.DeepEqual(algos[:len(want)], want) {
+		t.Errorf("preferAlgos = %v, want %v first", algos, want)
+	}
+}
+
+// TestTOFURecordsOnce checks that a key trusted on first use isn't recorded again when the same callback sees it
+// again, as it does when a connection is re-established.
+func TestTOFURecordsOnce(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "gosible-hostkey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "known_hosts")
+
+	target := &types.Target{Name: "t", Address: "example.com", Port: 22, KnownHosts: path, HostKeyPolicy: HostKeyTOFU}
+	cb, _, err := hostKeyCallback(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 22}
+	for i := 0; i < 3; i++ {
+		if err := cb("example.com:22", remote, signer.PublicKey()); err != nil {
+			t.Fatalf("attempt %d: %s", i+1, err)
+		}
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := bytes.Count(content, []byte("\n")); lines != 1 {
+		t.Errorf("known_hosts has %d lines, want 1:\n%s", lines, content)
+	}
+}
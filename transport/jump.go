@@ -0,0 +1,180 @@
+package transport
+
+import (
+	"fmt"
+	"github.com/pdbogen/gosible/types"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"strings"
+	"sync"
+)
+
+// jumpConn is a live connection to a jump host, shared by every target behind it.
+type jumpConn struct {
+	client  *ssh.Client
+	closers []io.Closer
+}
+
+// jumps holds the open jump host connections, keyed by the chain of hosts used to reach them (see jumpKey).
+var jumps = struct {
+	sync.Mutex
+	conns map[string]*jumpConn
+}{conns: map[string]*jumpConn{}}
+
+func sshAddress(t *types.Target) string {
+	port := t.Port
+	if port == 0 {
+		port = 22
+	}
+	return fmt.Sprintf("%s:%d", t.Address, port)
+}
+
+func jumpKey(chain []*types.Target) string {
+	hops := make([]string, len(chain))
+	for i, hop := range chain {
+		hops[i] = hop.User + "@" + sshAddress(hop)
+	}
+	return strings.Join(hops, ">")
+}
+
+// sshLogin is how to log in to a host: the ssh.ClientConfig, less its Auth; and the attempts at authentication (see
+// authAttempts) to make in turn until one succeeds.
+type sshLogin struct {
+	config   ssh.ClientConfig
+	attempts [][]*authRun
+}
+
+// loginConfig prepares the sshLogin for target. The returned closers must be closed once the connection is no longer
+// needed.
+func loginConfig(target *types.Target, credentials CredentialSource) (*sshLogin, []io.Closer, error) {
+	creds, err := credentials(target)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(creds) == 0 {
+		return nil, nil, fmt.Errorf("no credentials for %s@%s", target.User, sshAddress(target))
+	}
+
+	hkcb, algos, err := hostKeyCallback(target)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	attempts, closers, err := authAttempts(creds)
+	if err != nil {
+		return nil, nil, fmt.Errorf("preparing authentication for %s@%s: %s", target.User, sshAddress(target), err)
+	}
+
+	return &sshLogin{
+		config: ssh.ClientConfig{
+			User:              target.User,
+			HostKeyCallback:   hkcb,
+			HostKeyAlgorithms: algos,
+		},
+		attempts: attempts,
+	}, closers, nil
+}
+
+// dial connects and logs in to addr; directly if via is nil, or else tunnelled through via. Each attempt at
+// authentication gets a connection of its own, and the next is only made if the server turns the last one down.
+func (l *sshLogin) dial(via *ssh.Client, addr string) (client *ssh.Client, err error) {
+	for i, attempt := range l.attempts {
+		config := l.config
+		for _, run := range attempt {
+			config.Auth = append(config.Auth, run.method())
+		}
+		client, err = dialSSH(via, addr, &config)
+		if err == nil || !strings.Contains(err.Error(), "unable to authenticate") {
+			return client, err
+		}
+		if i < len(l.attempts)-1 {
+			log.Debugf("authentication to %s failed, trying the next credentials: %s", addr, err)
+		}
+	}
+	return nil, err
+}
+
+// dialSSH connects to addr; directly if via is nil, or else tunnelled through via.
+func dialSSH(via *ssh.Client, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	if via == nil {
+		return ssh.Dial("tcp", addr, config)
+	}
+
+	conn, err := via.Dial("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("tunnelling to %s: %s", addr, err)
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// acquireJump returns a connection to the last host in chain, tunnelled through the hosts before it. Connections are
+// shared: if one is already open to the same chain, it is reused. They stay open until CloseJumps is called, so that
+// targets run one after another don't each have to log in to the jump host again.
+func acquireJump(chain []*types.Target, credentials CredentialSource) (*ssh.Client, error) {
+	jumps.Lock()
+	defer jumps.Unlock()
+	return acquireJumpLocked(chain, credentials)
+}
+
+func acquireJumpLocked(chain []*types.Target, credentials CredentialSource) (*ssh.Client, error) {
+	if len(chain) == 0 {
+		return nil, nil
+	}
+
+	key := jumpKey(chain)
+	if conn, ok := jumps.conns[key]; ok {
+		if _, _, err := conn.client.SendRequest("keepalive@openssh.com", true, nil); err == nil {
+			return conn.client, nil
+		}
+		log.Warningf("connection to jump host %s lost, reconnecting", key)
+		conn.client.Close()
+		for _, c := range conn.closers {
+			c.Close()
+		}
+		delete(jumps.conns, key)
+	}
+
+	hop := chain[len(chain)-1]
+	via, err := acquireJumpLocked(chain[:len(chain)-1], credentials)
+	if err != nil {
+		return nil, err
+	}
+
+	login, closers, err := loginConfig(hop, credentials)
+	if err != nil {
+		return nil, fmt.Errorf("jump host %s: %s", key, err)
+	}
+
+	client, err := login.dial(via, sshAddress(hop))
+	if err != nil {
+		for _, c := range closers {
+			c.Close()
+		}
+		return nil, fmt.Errorf("connecting to jump host %s: %s", key, err)
+	}
+
+	log.Debugf("connected to jump host %s", key)
+	jumps.conns[key] = &jumpConn{client: client, closers: closers}
+	return client, nil
+}
+
+// CloseJumps closes every open jump host connection. Targets that are still connected through them will lose their
+// connections, so this should be called only once everything is done.
+func CloseJumps() {
+	jumps.Lock()
+	defer jumps.Unlock()
+
+	for key, conn := range jumps.conns {
+		log.Debugf("closing jump host %s", key)
+		conn.client.Close()
+		for _, c := range conn.closers {
+			c.Close()
+		}
+		delete(jumps.conns, key)
+	}
+}
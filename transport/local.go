@@ -0,0 +1,196 @@
+package transport
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/pdbogen/gosible/types"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// Local runs commands directly on the machine gosible itself is running on. It needs no credential.
+type Local struct {
+	// chroot, if set, is the directory commands are run in via chroot(8), and that paths are relative to; Chroot
+	// uses this.
+	chroot string
+}
+
+func (l *Local) Do(cmd []string) (stdout []byte, stderr []byte, result int, err error) {
+	return l.DoInput(cmd, []byte{})
+}
+
+func (l *Local) DoInput(cmd []string, stdin []byte) (stdout []byte, stderr []byte, result int, err error) {
+	return l.DoReader(cmd, bytes.NewBuffer(stdin))
+}
+
+func (l *Local) DoReader(cmd []string, stdin io.Reader) (stdout []byte, stderr []byte, result int, err error) {
+	outBuf := bytes.Buffer{}
+	errBuf := bytes.Buffer{}
+	result, err = l.DoStream(cmd, stdin, &outBuf, &errBuf)
+	if err != nil {
+		return nil, nil, result, err
+	}
+	return outBuf.Bytes(), errBuf.Bytes(), result, nil
+}
+
+func (l *Local) DoStream(cmd []string, stdin io.Reader, stdout, stderr io.Writer) (result int, err error) {
+	if l == nil {
+		return 255, fmt.Errorf("Local.Do called with nil Local")
+	}
+	if len(cmd) == 0 {
+		return 255, fmt.Errorf("Local.Do called with empty command")
+	}
+
+	if l.chroot != "" {
+		cmd = append([]string{"chroot", l.chroot}, cmd...)
+	}
+
+	c := exec.Command(cmd[0], cmd[1:]...)
+	c.Stdout = stdout
+	c.Stderr = stderr
+	c.Stdin = stdin
+
+	log.Debugf("running locally: %q", cmd)
+	err = c.Run()
+
+	status := 0
+	if err != nil {
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok {
+			return 255, fmt.Errorf("running command %s: %s", cmd, err)
+		}
+		if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			status = ws.ExitStatus()
+		} else {
+			status = 255
+		}
+	}
+
+	return status, nil
+}
+
+// maxLinks is how many symlinks path follows in one path before giving up, as the kernel does.
+const maxLinks = 40
+
+// path maps a path as seen by commands to one on this machine. Inside a chroot, each component is looked up under the
+// root, and symlinks are followed as they would be inside it: absolute targets are relative to the root, and ".."
+// never leads above it. So a link in the tree, like var/run -> /run, can't lead Put or Get out of the tree. The last
+// component may be missing, for Put to create; if it's a symlink, it's followed, as it would be by commands.
+func (l *Local) path(path string) (string, error) {
+	if l.chroot == "" {
+		return path, nil
+	}
+
+	var resolved []string
+	todo := strings.Split(path, "/")
+	links := 0
+	for len(todo) > 0 {
+		component := todo[0]
+		todo = todo[1:]
+		switch component {
+		case "", ".":
+			continue
+		case "..":
+			if len(resolved) > 0 {
+				resolved = resolved[:len(resolved)-1]
+			}
+			continue
+		}
+
+		host := filepath.Join(l.chroot, filepath.Join(resolved...), component)
+		fi, err := os.Lstat(host)
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			resolved = append(resolved, component)
+			continue
+		}
+
+		if links++; links > maxLinks {
+			return "", fmt.Errorf("%s: too many levels of symbolic links", path)
+		}
+		target, err := os.Readlink(host)
+		if err != nil {
+			return "", err
+		}
+		if strings.HasPrefix(target, "/") {
+			resolved = nil
+		}
+		todo = append(strings.Split(target, "/"), todo...)
+	}
+	return filepath.Join(l.chroot, filepath.Join(resolved...)), nil
+}
+
+// noFollow returns O_NOFOLLOW inside a chroot, where path has already resolved every symlink; so that one put in the
+// way since can't be followed out of the tree. Outside one, symlinks are followed as usual.
+func (l *Local) noFollow() int {
+	if l.chroot == "" {
+		return 0
+	}
+	return oNoFollow
+}
+
+func (l *Local) Put(path string, content io.Reader, mode os.FileMode) error {
+	if l == nil {
+		return fmt.Errorf("Local.Put called with nil Local")
+	}
+
+	path, err := l.path(path)
+	if err != nil {
+		return err
+	}
+	_, statErr := os.Stat(path)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|l.noFollow(), mode)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// OpenFile's mode is subject to the umask; so set it explicitly for new files.
+	if os.IsNotExist(statErr) {
+		if err := f.Chmod(mode); err != nil {
+			return fmt.Errorf("setting mode %04o on %s: %s", mode, path, err)
+		}
+	}
+
+	if _, err := io.Copy(f, content); err != nil {
+		return fmt.Errorf("writing %s: %s", path, err)
+	}
+	return f.Close()
+}
+
+func (l *Local) Get(path string, w io.Writer) error {
+	if l == nil {
+		return fmt.Errorf("Local.Get called with nil Local")
+	}
+
+	hostPath, err := l.path(path)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(hostPath, os.O_RDONLY|l.noFollow(), 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(w, f); err != nil {
+		return fmt.Errorf("reading %s: %s", path, err)
+	}
+	return nil
+}
+
+// Connect, like SSH.Connect, can be called on a nil pointer. There's nothing to connect to, so no credentials are
+// needed, and it never fails.
+func (*Local) Connect(*types.Target, CredentialSource) (Transport, error) {
+	return &Local{}, nil
+}
+
+func (*Local) Close() {}
+
+var _ Transport = (*Local)(nil)
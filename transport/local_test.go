@@ -0,0 +1,127 @@
+package transport
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLocalPathStaysInChroot(t *testing.T) {
+	root, err := ioutil.TempDir("", "gosible-chroot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	for _, dir := range []string{"etc", "run", "usr/share/zoneinfo"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, target := range map[string]string{
+		"var/run":       "/run",
+		"etc/localtime": "/usr/share/zoneinfo/UTC",
+		"etc/up":        "../../../..",
+		"etc/loop":      "loop",
+	} {
+		if err := os.MkdirAll(filepath.Join(root, filepath.Dir(link)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	l := &Local{chroot: root}
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/etc/hosts", "etc/hosts"},
+		{"/var/run/x.pid", "run/x.pid"},
+		{"/etc/localtime", "usr/share/zoneinfo/UTC"},
+		{"/etc/up/etc/passwd", "etc/passwd"},
+		{"/../../etc/passwd", "etc/passwd"},
+		{"/", ""},
+	}
+	for _, test := range tests {
+		got, err := l.path(test.path)
+		if err != nil {
+			t.Errorf("path(%q): %s", test.path, err)
+			continue
+		}
+		if want := filepath.Join(root, test.want); got != want {
+			t.Errorf("path(%q) = %q, want %q", test.path, got, want)
+		}
+	}
+
+	if _, err := l.path("/etc/loop"); err == nil {
+		t.Errorf("path(%q) followed a symlink loop without error", "/etc/loop")
+	}
+
+	if got, _ := (&Local{}).path("/etc/hosts"); got != "/etc/hosts" {
+		t.Errorf("path without chroot = %q, want it unchanged", got)
+	}
+}
+
+func TestLocal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gosible-local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tr, err := (*Local)(nil).Connect(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+
+	stdout, stderr, res, err := tr.Do([]string{"sh", "-c", `cd "$1" && pwd; echo oops >&2; exit 3`, "sh", dir})
+	if err != nil {
+		t.Fatalf("Do: %s", err)
+	}
+	if string(stdout) != dir+"\n" || string(stderr) != "oops\n" || res != 3 {
+		t.Errorf("Do = %q, %q, %d; want %q, %q, 3", stdout, stderr, res, dir+"\n", "oops\n")
+	}
+	if _, _, _, err := tr.Do([]string{filepath.Join(dir, "missing")}); err == nil {
+		t.Errorf("Do of a missing command succeeded, want an error")
+	}
+
+	stdout, _, res, err = tr.DoInput([]string{"tr", "a-z", "A-Z"}, []byte("hello\n"))
+	if err != nil || string(stdout) != "HELLO\n" || res != 0 {
+		t.Errorf("DoInput = %q, %d, %v; want %q, 0, nil", stdout, res, err, "HELLO\n")
+	}
+
+	path := filepath.Join(dir, "file")
+	if err := tr.Put(path, strings.NewReader("first, longer content\n"), 0640); err != nil {
+		t.Fatalf("Put: %s", err)
+	}
+	if fi, err := os.Stat(path); err != nil {
+		t.Errorf("Put didn't create %s: %s", path, err)
+	} else if fi.Mode().Perm() != 0640 {
+		t.Errorf("Put created %s with mode %v, want 0640", path, fi.Mode().Perm())
+	}
+	if err := tr.Put(path, strings.NewReader("second\n"), 0600); err != nil {
+		t.Fatalf("Put over an existing file: %s", err)
+	}
+	if fi, err := os.Stat(path); err != nil {
+		t.Error(err)
+	} else if fi.Mode().Perm() != 0640 {
+		t.Errorf("Put over %s changed its mode to %v, want it kept at 0640", path, fi.Mode().Perm())
+	}
+
+	buf := &bytes.Buffer{}
+	if err := tr.Get(path, buf); err != nil {
+		t.Fatalf("Get: %s", err)
+	}
+	if buf.String() != "second\n" {
+		t.Errorf("Get = %q, want %q", buf.String(), "second\n")
+	}
+	if err := tr.Get(filepath.Join(dir, "missing"), &bytes.Buffer{}); err == nil {
+		t.Errorf("Get of a missing file succeeded, want an error")
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !windows
+// +build !windows
+
+package transport
+
+import "syscall"
+
+// oNoFollow makes opening a symlink fail, rather than open what it points to.
+const oNoFollow = syscall.O_NOFOLLOW
@@ -0,0 +1,4 @@
+package transport
+
+// oNoFollow is zero on Windows, which has no O_NOFOLLOW; nor any chroot to escape from.
+const oNoFollow = 0
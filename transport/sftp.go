@@ -0,0 +1,103 @@
+package transport
+
+import (
+	"fmt"
+	"github.com/pkg/sftp"
+	"io"
+	"os"
+)
+
+// sftp opens an SFTP client over a new session. The session counts against the connection's session limit until
+// the returned function is called to close it.
+func (s *SSH) sftp() (*sftp.Client, func(), error) {
+	sess, err := s.session()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed opening session: %s", err)
+	}
+
+	closeSess := func() {
+		sess.Close()
+		s.release()
+	}
+
+	wr, err := sess.StdinPipe()
+	if err != nil {
+		closeSess()
+		return nil, nil, fmt.Errorf("opening sftp stdin: %s", err)
+	}
+	rd, err := sess.StdoutPipe()
+	if err != nil {
+		closeSess()
+		return nil, nil, fmt.Errorf("opening sftp stdout: %s", err)
+	}
+	if err := sess.RequestSubsystem("sftp"); err != nil {
+		closeSess()
+		return nil, nil, fmt.Errorf("requesting sftp subsystem: %s", err)
+	}
+
+	client, err := sftp.NewClientPipe(rd, wr)
+	if err != nil {
+		closeSess()
+		return nil, nil, fmt.Errorf("starting sftp: %s", err)
+	}
+	return client, func() {
+		client.Close()
+		closeSess()
+	}, nil
+}
+
+func (s *SSH) Put(path string, content io.Reader, mode os.FileMode) error {
+	if s == nil {
+		return fmt.Errorf("SSH.Put called with nil SSH")
+	}
+
+	client, done, err := s.sftp()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	_, statErr := client.Stat(path)
+	f, err := client.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return fmt.Errorf("opening %s: %s", path, err)
+	}
+	defer f.Close()
+
+	// Set the mode before any content is written, so that the content is never readable with the wrong permissions.
+	if os.IsNotExist(statErr) {
+		if err := f.Chmod(mode); err != nil {
+			return fmt.Errorf("setting mode %04o on %s: %s", mode, path, err)
+		}
+	}
+
+	log.Debugf("sftp: writing %s", path)
+	if _, err := f.ReadFrom(content); err != nil {
+		return fmt.Errorf("writing %s: %s", path, err)
+	}
+	return f.Close()
+}
+
+func (s *SSH) Get(path string, w io.Writer) error {
+	if s == nil {
+		return fmt.Errorf("SSH.Get called with nil SSH")
+	}
+
+	client, done, err := s.sftp()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	f, err := client.Open(path)
+	if err != nil {
+		return fmt.Errorf("opening %s: %s", path, err)
+	}
+	defer f.Close()
+
+	log.Debugf("sftp: reading %s", path)
+	if _, err := f.WriteTo(w); err != nil {
+		return fmt.Errorf("reading %s: %s", path, err)
+	}
+	return nil
+}
@@ -8,14 +8,38 @@ import (
 	"golang.org/x/crypto/ssh"
 	"io"
 	"strings"
+	"sync"
+	"time"
 )
 
+// DefaultMaxSessions matches OpenSSH's default MaxSessions.
+const DefaultMaxSessions = 10
+
+// DefaultKeepAlive is the default number of seconds between keepalives.
+const DefaultKeepAlive = 30
+
+// maxReconnects is how many times in a row session reconnects before giving up on a connection that keeps failing.
+// It waits a second longer before each attempt than before the last.
+const maxReconnects = 3
+
 type SSH struct {
 	Address  string
 	Username string
 	Port     int32
-	Password string
 	ssh      *ssh.Client
+	closers  []io.Closer
+
+	// mu guards ssh, which is replaced when the connection has to be re-established.
+	mu   sync.Mutex
+	dial func() (*ssh.Client, error)
+
+	// sessions holds one token per session we may have open at once. limit is its effective size: when the server
+	// refuses a session, we hold on to one token for good, so that we stay under the server's own MaxSessions.
+	sessions chan struct{}
+	limit    int
+
+	// stop is closed, once, when the connection is closed for good, to stop the keepalives.
+	stop chan struct{}
 }
 
 var log = logging.MustGetLogger("gosible/transport/ssh")
@@ -29,19 +53,29 @@ func (s *SSH) DoInput(cmd []string, stdin []byte) (stdout []byte, stderr []byte,
 }
 
 func (s *SSH) DoReader(cmd []string, stdin io.Reader) (stdout []byte, stderr []byte, result int, err error) {
+	outBuf := bytes.Buffer{}
+	errBuf := bytes.Buffer{}
+	result, err = s.DoStream(cmd, stdin, &outBuf, &errBuf)
+	if err != nil {
+		return nil, nil, result, err
+	}
+	return outBuf.Bytes(), errBuf.Bytes(), result, nil
+}
+
+func (s *SSH) DoStream(cmd []string, stdin io.Reader, stdout, stderr io.Writer) (result int, err error) {
 	if s == nil {
-		return nil, nil, 255, fmt.Errorf("SSH.Do called with nil SSH")
+		return 255, fmt.Errorf("SSH.Do called with nil SSH")
 	}
 
-	sess, err := s.ssh.NewSession()
+	sess, err := s.session()
 	if err != nil {
-		return nil, nil, 255, fmt.Errorf("failed opening session: %s", err)
+		return 255, fmt.Errorf("failed opening session: %s", err)
 	}
+	defer s.release()
+	defer sess.Close()
 
-	outBuf := bytes.Buffer{}
-	errBuf := bytes.Buffer{}
-	sess.Stdout = &outBuf
-	sess.Stderr = &errBuf
+	sess.Stdout = stdout
+	sess.Stderr = stderr
 	sess.Stdin = stdin
 
 	for i, s := range cmd[1:] {
@@ -60,61 +94,201 @@ func (s *SSH) DoReader(cmd []string, stdin io.Reader) (stdout []byte, stderr []b
 			status = err.(*ssh.ExitError).ExitStatus()
 			break
 		default:
-			return nil, nil, 255, fmt.Errorf("running command %s: %s", cmd, err)
+			return 255, fmt.Errorf("running command %s: %s", cmd, err)
 		}
 	}
 
-	return outBuf.Bytes(), errBuf.Bytes(), status, nil
+	return status, nil
+}
+
+// session waits for a free session slot, and then opens a session; reconnecting first, if the connection has been
+// lost. The caller must call release once the session is closed.
+func (s *SSH) session() (*ssh.Session, error) {
+	reconnects := 0
+	for {
+		s.sessions <- struct{}{}
+
+		client, err := s.client()
+		if err != nil {
+			s.release()
+			return nil, err
+		}
+
+		sess, err := client.NewSession()
+		if err == nil {
+			return sess, nil
+		}
+
+		if openErr, ok := err.(*ssh.OpenChannelError); ok {
+			if openErr.Reason != ssh.Prohibited {
+				s.release()
+				return nil, err
+			}
+			s.mu.Lock()
+			if s.limit <= 1 {
+				s.mu.Unlock()
+				s.release()
+				return nil, err
+			}
+			// Keep our token; the server won't let us have that many sessions.
+			s.limit--
+			log.Warningf("%s@%s:%d refused a session, limiting to %d concurrent sessions", s.Username, s.Address, s.Port, s.limit)
+			s.mu.Unlock()
+			continue
+		}
+
+		// Anything else means the connection itself is broken; drop it, so that the next attempt reconnects.
+		s.release()
+		if !s.drop(client) {
+			return nil, err
+		}
+		if reconnects++; reconnects > maxReconnects {
+			return nil, fmt.Errorf("giving up after %d reconnects: %s", maxReconnects, err)
+		}
+		log.Warningf("connection to %s@%s:%d lost (%s), reconnecting", s.Username, s.Address, s.Port, err)
+		time.Sleep(time.Duration(reconnects) * time.Second)
+	}
+}
+
+func (s *SSH) release() {
+	<-s.sessions
+}
+
+// client returns the live connection, re-establishing it if it has been dropped.
+func (s *SSH) client() (*ssh.Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ssh != nil {
+		return s.ssh, nil
+	}
+	if s.dial == nil {
+		return nil, fmt.Errorf("not connected to %s@%s:%d", s.Username, s.Address, s.Port)
+	}
+	client, err := s.dial()
+	if err != nil {
+		return nil, fmt.Errorf("reconnecting to %s@%s:%d: %s", s.Username, s.Address, s.Port, err)
+	}
+	s.ssh = client
+	return client, nil
+}
+
+// drop discards the given connection, if it is still the live one, so that the next use reconnects. It returns false
+// if reconnecting isn't possible.
+func (s *SSH) drop(client *ssh.Client) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ssh == client {
+		client.Close()
+		s.ssh = nil
+	}
+	return s.dial != nil
+}
+
+// keepAlive periodically pings the server, so that idle connections aren't timed out by NATs or VPNs; and so that a
+// dead connection is noticed and replaced before the next command needs it. It returns once stop is closed.
+func (s *SSH) keepAlive(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		s.mu.Lock()
+		client := s.ssh
+		s.mu.Unlock()
+		if client == nil {
+			continue
+		}
+
+		if _, _, err := client.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+			log.Warningf("keepalive to %s@%s:%d failed: %s", s.Username, s.Address, s.Port, err)
+			s.drop(client)
+		}
+	}
 }
 
 // Connect is "static," in that it does not reference the receive it's called on; so it can be called on a nil pointer
 // to SSH. This is good, because it's a sort of constructor to create a live SSH connection.
-// Thus, it returns an SSH connection to the given target authenticated with the given credential; or an error, if
-// something went wrong.
-func (*SSH) Connect(target *types.Target, cred *types.Credential) (Transport, error) {
+// Thus, it returns an SSH connection to the given target authenticated with the first of its credentials that works,
+// tunnelled through the target's jump hosts if it has any; or an error, if something went wrong.
+func (*SSH) Connect(target *types.Target, credentials CredentialSource) (Transport, error) {
 	if target == nil {
 		return nil, fmt.Errorf("SSH.Connect called with nil target")
 	}
 
-	if cred == nil {
-		return nil, fmt.Errorf("SSH.Connect called with nil credential")
+	maxSessions := target.MaxSessions
+	if maxSessions <= 0 {
+		maxSessions = DefaultMaxSessions
 	}
 
 	new_ssh := &SSH{
 		Address:  target.Address,
 		Port:     target.Port,
 		Username: target.User,
-		Password: cred.Value,
+		sessions: make(chan struct{}, maxSessions),
+		limit:    maxSessions,
+		stop:     make(chan struct{}),
 	}
 
-	hkcb := ssh.InsecureIgnoreHostKey()
-	if target.HostKey != nil {
-		key, err := ssh.ParsePublicKey([]byte(*target.HostKey))
-		if err != nil {
-			return nil, fmt.Errorf("provided host key for target %s@%s:%d could not be parsed: %s", target.User, target.Address, target.Port, err)
-		}
-		hkcb = ssh.FixedHostKey(key)
+	login, closers, err := loginConfig(target, credentials)
+	if err != nil {
+		return nil, err
 	}
-	config := &ssh.ClientConfig{
-		User: target.User,
-		Auth: []ssh.AuthMethod{
-			ssh.Password(cred.Value),
-		},
-		HostKeyCallback: hkcb,
+	new_ssh.closers = closers
+
+	via, err := acquireJump(target.Jumps, credentials)
+	if err != nil {
+		new_ssh.Close()
+		return nil, fmt.Errorf("connecting to %s@%s: %s", target.User, sshAddress(target), err)
 	}
 
-	var err error
-	new_ssh.ssh, err = ssh.Dial("tcp", fmt.Sprintf("%s:%d", target.Address, target.Port), config)
+	new_ssh.ssh, err = login.dial(via, sshAddress(target))
 	if err != nil {
-		return nil, fmt.Errorf("connecting to %s@%s:%d: %s", target.User, target.Address, target.Port, err)
+		new_ssh.Close()
+		return nil, fmt.Errorf("connecting to %s@%s: %s", target.User, sshAddress(target), err)
+	}
+
+	new_ssh.dial = func() (*ssh.Client, error) {
+		via, err := acquireJump(target.Jumps, credentials)
+		if err != nil {
+			return nil, err
+		}
+		return login.dial(via, sshAddress(target))
+	}
+
+	keepAlive := target.KeepAlive
+	if keepAlive == 0 {
+		keepAlive = DefaultKeepAlive
+	}
+	if keepAlive > 0 {
+		go new_ssh.keepAlive(time.Duration(keepAlive)*time.Second, new_ssh.stop)
 	}
 
 	return new_ssh, nil
 }
 
 func (s *SSH) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	select {
+	case <-s.stop:
+	default:
+		close(s.stop)
+	}
+	s.dial = nil
 	if s.ssh != nil {
 		s.ssh.Close()
+		s.ssh = nil
+	}
+	for _, c := range s.closers {
+		c.Close()
 	}
 }
 
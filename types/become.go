@@ -0,0 +1,29 @@
+package types
+
+// Become describes privilege escalation. It can appear on a Target, a Set, or a Task; settings on a Task override
+// those of the Set it's in, which override those of the Target. Become is a pointer so that a Task can explicitly
+// turn off escalation that was enabled further up.
+type Become struct {
+	Become *bool  `yaml:"become"`
+	User   string `yaml:"become_user"`   // Default: root
+	Method string `yaml:"become_method"` // Default: sudo
+}
+
+// Enabled returns true if privilege escalation was requested.
+func (b Become) Enabled() bool {
+	return b.Become != nil && *b.Become
+}
+
+// Merge returns a copy of b, with any fields that are set in o taking precedence.
+func (b Become) Merge(o Become) Become {
+	if o.Become != nil {
+		b.Become = o.Become
+	}
+	if o.User != "" {
+		b.User = o.User
+	}
+	if o.Method != "" {
+		b.Method = o.Method
+	}
+	return b
+}
@@ -1,6 +1,30 @@
 package types
 
+// Credential types; see Credential.
+const (
+	CredentialPassword = "password"
+	CredentialKey      = "key"
+	CredentialAgent    = "agent"
+)
+
+// A Credential is something a transport can authenticate with. Type selects how the remaining fields are used:
+//
+//	password -- Value is the password. This is the default.
+//	key      -- Value is a PEM or OpenSSH private key; or, if Value is empty, Path names a file containing one.
+//	            Passphrase decrypts an encrypted key.
+//	agent    -- Path names the ssh-agent socket; if empty, $SSH_AUTH_SOCK is used.
 type Credential struct {
-	Name  string
-	Value string
+	Name       string
+	Type       string
+	Value      string
+	Path       string
+	Passphrase string
+}
+
+// Kind returns the credential's type, with the default applied.
+func (c *Credential) Kind() string {
+	if c.Type == "" {
+		return CredentialPassword
+	}
+	return c.Type
 }
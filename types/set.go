@@ -2,6 +2,7 @@ package types
 
 // A TaskSet is like a target without all the targeting parameters...
 type Set struct {
-	Name  string
-	Tasks []*Task
+	Name   string
+	Tasks  []*Task
+	Become `yaml:",inline"`
 }
@@ -6,8 +6,31 @@ type Target struct {
 	Port           int32
 	User           string
 	CredentialName string `yaml:"credentialName"`
-	TransportName  string // Default: SSH
-	Metadata       map[string]string
-	Tasks          []*Task
-	HostKey        *string
+	// CredentialNames lists further credentials, which are tried in order after CredentialName.
+	CredentialNames []string `yaml:"credentialNames"`
+	TransportName   string   // Default: SSH
+	Metadata        map[string]string
+	Tasks           []*Task
+	HostKey         *string
+	// MaxSessions caps the number of commands run at once over a single connection. It's lowered automatically if
+	// the server refuses sessions. Default: 10, which is OpenSSH's default MaxSessions.
+	MaxSessions int `yaml:"maxSessions"`
+	// KeepAlive is the number of seconds between keepalives; negative disables them. Default: 30
+	KeepAlive int `yaml:"keepAlive"`
+	// Jumps lists SSH jump hosts, in the order they're passed through to reach this target. Each is described by its
+	// address, port, user, credentials and host key settings; the other fields are ignored.
+	Jumps []*Target `yaml:"jumps"`
+	// KnownHosts is the known_hosts file that host keys are checked against, relative to the payload root. Default:
+	// ~/.ssh/known_hosts
+	KnownHosts string `yaml:"knownHosts"`
+	// HostKeyPolicy is one of strict (the key must be in KnownHosts), tofu (an unknown key is added to KnownHosts),
+	// or insecure (the key is not checked). Default: tofu. HostKey, if set, overrides both.
+	HostKeyPolicy string `yaml:"hostKeyPolicy"`
+	// Archive, for the chroot transport, names a tar archive (gzipped, if it ends in .gz or .tgz) that the tree is
+	// packed into once the target's tasks are done. It's relative to the payload root.
+	Archive string `yaml:"archive"`
+	Become  `yaml:",inline"`
+	// BecomeCredentialName names the credential holding the password for privilege escalation. If empty, the
+	// target's own credential is used, which is what sudo expects.
+	BecomeCredentialName string `yaml:"becomeCredentialName"`
 }
@@ -1,8 +1,9 @@
 package types
 
 // This YAML parsing is slightly fancy; a Task is an object. Its yaml `name` field becomes Name.
-// Every other field becomes a key in Modules.
+// Every other field, except for the privilege escalation fields of Become, becomes a key in Modules.
 type Task struct {
 	Name    string
+	Become  `yaml:",inline"`
 	Modules map[string]map[string]string `yaml:",inline"`
 }